@@ -82,7 +82,7 @@ type Server struct {
 
 	ffsManager *manager.Manager
 	sched      *scheduler.Scheduler
-	hs         ffs.HotStorage
+	hs         *coreipfs.CoreIpfs
 	l          *joblogger.Logger
 
 	grpcServer *grpc.Server
@@ -122,12 +122,17 @@ type Config struct {
 	FFSDealFinalityTimeout      time.Duration
 	FFSMinimumPieceSize         uint64
 	FFSMaxParallelDealPreparing int
-	SchedMaxParallel            int
-	MinerSelector               string
-	MinerSelectorParams         string
-	DealWatchPollDuration       time.Duration
-	AutocreateMasterAddr        bool
-	WalletInitialFunds          big.Int
+	// FFSHotStorageMonitorInterval enables the hot storage IPFS
+	// node connectivity monitor if greater than zero.
+	FFSHotStorageMonitorInterval time.Duration
+	// FFSHotStorageReadOnly starts hot storage in read-only mode.
+	FFSHotStorageReadOnly bool
+	SchedMaxParallel      int
+	MinerSelector         string
+	MinerSelectorParams   string
+	DealWatchPollDuration time.Duration
+	AutocreateMasterAddr  bool
+	WalletInitialFunds    big.Int
 
 	AskIndexQueryAskTimeout time.Duration
 	AskindexMaxParallel     int
@@ -245,10 +250,13 @@ func NewServer(conf Config) (*Server, error) {
 		conf.FFSMinimumPieceSize = 0
 	}
 	cs := filcold.New(ms, dm, ipfs, chain, l, lsm, conf.FFSMinimumPieceSize, conf.FFSMaxParallelDealPreparing)
-	hs, err := coreipfs.New(ipfs, l)
+	hs, err := coreipfs.New(ipfs, l, coreipfs.WithConnectivityMonitor(conf.FFSHotStorageMonitorInterval))
 	if err != nil {
 		return nil, fmt.Errorf("creating coreipfs: %s", err)
 	}
+	if conf.FFSHotStorageReadOnly {
+		hs.SetReadOnly(true)
+	}
 
 	var sr2rf func() (int, error)
 	if ms, ok := ms.(*sr2.MinerSelector); ok {
@@ -266,13 +274,14 @@ func NewServer(conf Config) (*Server, error) {
 
 	log.Info("Starting gRPC, gateway and index HTTP servers...")
 
-	unaryInterceptors := []grpc.UnaryServerInterceptor{adminAuth(conf)}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{requestIDUnaryInterceptor(), adminAuth(conf)}
 	if conf.DisableNonCompliantAPIs {
 		unaryInterceptors = append(unaryInterceptors, nonCompliantAPIsInterceptor(nonCompliantAPIs))
 	}
 	unaryInterceptorChain := grpcm.WithUnaryServerChain(unaryInterceptors...)
+	streamInterceptorChain := grpcm.WithStreamServerChain(requestIDStreamInterceptor())
 
-	opts := append(conf.GrpcServerOpts, unaryInterceptorChain)
+	opts := append(conf.GrpcServerOpts, unaryInterceptorChain, streamInterceptorChain)
 	grpcServer := grpc.NewServer(opts...)
 	wrappedGRPCServer := wrapGRPCServer(grpcServer)
 	httpFFSAuthInterceptor, err := newHTTPFFSAuthInterceptor(conf, ffsManager)
@@ -499,6 +508,9 @@ func (s *Server) Close() {
 	if err := s.sched.Close(); err != nil {
 		log.Errorf("closing ffs scheduler: %s", err)
 	}
+	if err := s.hs.Close(); err != nil {
+		log.Errorf("closing hot storage: %s", err)
+	}
 	if err := s.l.Close(); err != nil {
 		log.Errorf("closing joblogger: %s", err)
 	}
@@ -618,6 +630,28 @@ func adminAuth(conf Config) grpc.UnaryServerInterceptor {
 	}
 }
 
+func requestIDUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withRequestID(ctx), req)
+	}
+}
+
+func requestIDStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wrapped := grpcm.WrapServerStream(ss)
+		wrapped.WrappedContext = withRequestID(ss.Context())
+		return handler(srv, wrapped)
+	}
+}
+
+func withRequestID(ctx context.Context) context.Context {
+	id := metautils.ExtractIncoming(ctx).Get("X-request-id")
+	if id == "" {
+		return ctx
+	}
+	return coreipfs.WithRequestID(ctx, id)
+}
+
 func nonCompliantAPIsInterceptor(nonCompliantAPIs []string) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		method, _ := grpc.Method(ctx)
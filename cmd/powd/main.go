@@ -130,6 +130,8 @@ func configFromFlags() (server.Config, error) {
 	ffsDealWatchFinalityTimeout := time.Minute * time.Duration(config.GetInt("ffsdealfinalitytimeout"))
 	ffsMinimumPieceSize := config.GetUint64("ffsminimumpiecesize")
 	ffsMaxParallelDealPreparing := config.GetInt("ffsmaxparalleldealpreparing")
+	ffsHotStorageMonitorInterval := time.Second * time.Duration(config.GetInt("ffshotstoragemonitorinterval"))
+	ffsHotStorageReadOnly := config.GetBool("ffshotstoragereadonly")
 	dealWatchPollDuration := time.Second * time.Duration(config.GetInt("dealwatchpollduration"))
 	askIndexQueryAskTimeout := time.Second * time.Duration(config.GetInt("askindexqueryasktimeout"))
 	askIndexRefreshInterval := time.Minute * time.Duration(config.GetInt("askindexrefreshinterval"))
@@ -162,16 +164,18 @@ func configFromFlags() (server.Config, error) {
 		MongoURI: mongoURI,
 		MongoDB:  mongoDB,
 
-		FFSAdminToken:               ffsAdminToken,
-		FFSUseMasterAddr:            ffsUseMasterAddr,
-		FFSDealFinalityTimeout:      ffsDealWatchFinalityTimeout,
-		FFSMinimumPieceSize:         ffsMinimumPieceSize,
-		FFSMaxParallelDealPreparing: ffsMaxParallelDealPreparing,
-		AutocreateMasterAddr:        autocreateMasterAddr,
-		MinerSelector:               minerSelector,
-		MinerSelectorParams:         minerSelectorParams,
-		SchedMaxParallel:            ffsSchedMaxParallel,
-		DealWatchPollDuration:       dealWatchPollDuration,
+		FFSAdminToken:                ffsAdminToken,
+		FFSUseMasterAddr:             ffsUseMasterAddr,
+		FFSDealFinalityTimeout:       ffsDealWatchFinalityTimeout,
+		FFSMinimumPieceSize:          ffsMinimumPieceSize,
+		FFSMaxParallelDealPreparing:  ffsMaxParallelDealPreparing,
+		FFSHotStorageMonitorInterval: ffsHotStorageMonitorInterval,
+		FFSHotStorageReadOnly:        ffsHotStorageReadOnly,
+		AutocreateMasterAddr:         autocreateMasterAddr,
+		MinerSelector:                minerSelector,
+		MinerSelectorParams:          minerSelectorParams,
+		SchedMaxParallel:             ffsSchedMaxParallel,
+		DealWatchPollDuration:        dealWatchPollDuration,
 
 		AskIndexQueryAskTimeout: askIndexQueryAskTimeout,
 		AskIndexRefreshInterval: askIndexRefreshInterval,
@@ -363,6 +367,8 @@ func setupFlags() error {
 	pflag.String("ffsschedmaxparallel", "1000", "Maximum amount of Jobs executed in parallel")
 	pflag.String("ffsdealfinalitytimeout", "4320", "Deadline in minutes in which a deal must prove liveness changing status before considered abandoned")
 	pflag.String("ffsmaxparalleldealpreparing", "2", "Max parallel deal preparing tasks")
+	pflag.Bool("ffshotstoragereadonly", false, "Start hot storage in read-only mode, rejecting data adds and pin changes in the IPFS node.")
+	pflag.String("ffshotstoragemonitorinterval", "0", "Interval in seconds to check the IPFS node availability, failing hot storage mutations fast while it's down. (Optional: if 0, it's disabled)")
 	pflag.String("dealwatchpollduration", "900", "Poll interval in seconds used by Deals Module watch to detect state changes")
 
 	pflag.String("askindexqueryasktimeout", "15", "Timeout in seconds for a query ask")
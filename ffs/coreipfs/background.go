@@ -0,0 +1,73 @@
+package coreipfs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// StoreInBackground pins c without waiting for its data to be fetched. It
+// returns true if a background fetch is in progress, or false if c was
+// already stored. The cid is considered stored once the pin finishes, and
+// until then Get may fail or block; IsFetching and IsComplete can be used
+// to check the progress. If the background pin fails, the error is logged
+// and returned by FetchError until c is stored in background again.
+func (ci *CoreIpfs) StoreInBackground(ctx context.Context, c cid.Cid) (bool, error) {
+	if err := ci.checkMutable(); err != nil {
+		return false, err
+	}
+	if stored, _ := ci.IsStored(ctx, c); stored {
+		return false, nil
+	}
+
+	ci.clsLock.Lock()
+	defer ci.clsLock.Unlock()
+	if ci.closed {
+		return false, fmt.Errorf("hot storage is closed")
+	}
+	ci.lock.Lock()
+	if _, ok := ci.fetching[pinsetKey(c)]; ok {
+		ci.lock.Unlock()
+		return true, nil
+	}
+	ci.fetching[pinsetKey(c)] = struct{}{}
+	delete(ci.fetchErrs, pinsetKey(c))
+	ci.lock.Unlock()
+
+	// The caller ctx may be canceled after returning, so the pin
+	// is bound to the CoreIpfs lifetime, keeping the caller values.
+	bctx := WithRequestID(ci.ctx, RequestID(ctx))
+	if offline, ok := ctx.Value(offlinePinKey{}).(bool); ok {
+		bctx = WithOfflinePin(bctx, offline)
+	}
+	ci.bgWg.Add(1)
+	go func() {
+		defer ci.bgWg.Done()
+		_, err := ci.Store(bctx, c)
+		ci.lock.Lock()
+		defer ci.lock.Unlock()
+		delete(ci.fetching, pinsetKey(c))
+		if err != nil && ci.ctx.Err() == nil {
+			logger(bctx).Errorf("background pinning of cid %s: %s", c, err)
+			ci.fetchErrs[pinsetKey(c)] = err
+		}
+	}()
+	return true, nil
+}
+
+// IsFetching returns true if c is being pinned by StoreInBackground.
+func (ci *CoreIpfs) IsFetching(c cid.Cid) bool {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	_, ok := ci.fetching[pinsetKey(c)]
+	return ok
+}
+
+// FetchError returns the error of the last background pin of c started
+// with StoreInBackground, or nil if it didn't fail or is in progress.
+func (ci *CoreIpfs) FetchError(c cid.Cid) error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	return ci.fetchErrs[pinsetKey(c)]
+}
@@ -1,56 +1,227 @@
 package coreipfs
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	ipfsfiles "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
+	dag "github.com/ipfs/go-merkledag"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/textileio/powergate/ffs"
 )
 
+const (
+	// getManyMaxParallel is the maximum number of concurrent
+	// fetches done by GetMany.
+	getManyMaxParallel = 10
+	// maxChunkSize is the largest block size accepted by go-ipfs.
+	maxChunkSize = 1 << 20
+)
+
 var (
 	log = logging.Logger("ffs-coreipfs")
+
+	// ErrReadOnly is returned when trying to mutate hot storage while
+	// it's in read-only mode.
+	ErrReadOnly = errors.New("hot storage is in read-only mode")
+
+	// ErrNotFound is returned when the IPFS node can't resolve a cid
+	// from locally available blocks.
+	ErrNotFound = errors.New("cid not found in the node")
+
+	// ErrHotStorageUnavailable is returned when trying to mutate hot
+	// storage while the connectivity monitor considers the IPFS node down.
+	ErrHotStorageUnavailable = errors.New("ipfs node is unavailable")
+
+	// ErrNotDirectory is returned when listing a cid which isn't a
+	// UnixFS directory.
+	ErrNotDirectory = errors.New("cid isn't a unixfs directory")
+
+	// ErrPathNotFound is returned when a subpath doesn't exist under
+	// a directory.
+	ErrPathNotFound = errors.New("path not found under directory")
+
+	// ErrBlockNotLocal is returned when pinning in offline mode and
+	// some block of the DAG isn't available in the IPFS node.
+	ErrBlockNotLocal = errors.New("dag blocks aren't available locally")
 )
 
 // CoreIpfs is an implementation of HotStorage interface which saves data
 // into a remote go-ipfs using the HTTP API.
+//
+// The IPFS node pinset is the source of truth, and the pinset cache is
+// updated right after each successful pin mutation in the node. If a later
+// step fails, the cache still reflects the node state.
+//
+// The node pins cids by their exact version, so the cache groups the exact
+// pinned cids by their normalized CIDv1. Content pinned as CIDv0 is stored
+// for its CIDv1 too, and Remove or Replace unpin every version pinned for it.
 type CoreIpfs struct {
 	ipfs iface.CoreAPI
 	l    ffs.JobLogger
+	cfg  config
+
+	lock sync.Mutex
+	// pinset maps the normalized cid of pinned content
+	// to the exact cids pinned in the node.
+	pinset    map[cid.Cid][]cid.Cid
+	readOnly  bool
+	available bool
+	// uniqueSizes caches UniqueSize results, and it's
+	// invalidated each time the pinset changes.
+	uniqueSizes   map[cid.Cid]int64
+	pinsetVersion uint64
+	// ipnsNames tracks the cid currently stored for
+	// each name stored with StoreIPNS.
+	ipnsNames map[string]cid.Cid
+	// ipnsExpiring contains cids that a tracked name stopped
+	// pointing to, and when they should be removed.
+	ipnsExpiring map[cid.Cid]time.Time
+	ipnsWatchers []chan IPNSFollow
+	// fetching contains cids being pinned by StoreInBackground,
+	// and fetchErrs the errors of the ones which failed.
+	fetching  map[cid.Cid]struct{}
+	fetchErrs map[cid.Cid]error
+	bgWg      sync.WaitGroup
 
-	lock   sync.Mutex
-	pinset map[cid.Cid]struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	finished chan struct{}
+	clsLock  sync.Mutex
+	closed   bool
 }
 
 var _ ffs.HotStorage = (*CoreIpfs)(nil)
 
 // New returns a new CoreIpfs instance.
-func New(ipfs iface.CoreAPI, l ffs.JobLogger) (*CoreIpfs, error) {
+func New(ipfs iface.CoreAPI, l ffs.JobLogger, opts ...Option) (*CoreIpfs, error) {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	if cfg.chunkSize < 0 || cfg.chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunk size should be between 1 and %d", maxChunkSize)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	ci := &CoreIpfs{
-		ipfs: ipfs,
-		l:    l,
+		ipfs:         ipfs,
+		l:            l,
+		cfg:          cfg,
+		available:    true,
+		ipnsNames:    make(map[string]cid.Cid),
+		ipnsExpiring: make(map[cid.Cid]time.Time),
+		fetching:     make(map[cid.Cid]struct{}),
+		fetchErrs:    make(map[cid.Cid]error),
+		ctx:          ctx,
+		cancel:       cancel,
+		finished:     make(chan struct{}),
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
-	if err := ci.fillPinsetCache(ctx); err != nil {
+	fillCtx, fillCancel := context.WithTimeout(ctx, time.Second*30)
+	defer fillCancel()
+	if err := ci.fillPinsetCache(fillCtx); err != nil {
+		cancel()
 		return nil, err
 	}
+	var wg sync.WaitGroup
+	if cfg.monitorInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ci.monitor()
+		}()
+	}
+	if cfg.ipnsInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ci.followIPNS()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ci.finished)
+	}()
 	return ci, nil
 }
 
+// Close closes the CoreIpfs instance, stopping the connectivity
+// monitor and the IPNS follower if enabled, and canceling background
+// fetches.
+func (ci *CoreIpfs) Close() error {
+	ci.clsLock.Lock()
+	defer ci.clsLock.Unlock()
+	if ci.closed {
+		return nil
+	}
+	ci.cancel()
+	<-ci.finished
+	ci.bgWg.Wait()
+	ci.lock.Lock()
+	for _, w := range ci.ipnsWatchers {
+		close(w)
+	}
+	ci.ipnsWatchers = nil
+	ci.lock.Unlock()
+	ci.closed = true
+	return nil
+}
+
+// SetReadOnly enables or disables read-only mode. While enabled, Add, Remove,
+// Store and Replace return ErrReadOnly, and Get and IsStored keep working.
+func (ci *CoreIpfs) SetReadOnly(readOnly bool) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	ci.readOnly = readOnly
+	log.Infof("read-only mode set to %t", readOnly)
+}
+
+// IsReadOnly returns true if read-only mode is enabled.
+func (ci *CoreIpfs) IsReadOnly() bool {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	return ci.readOnly
+}
+
+// checkMutable returns an error if hot storage can't be mutated,
+// either because it's in read-only mode or the IPFS node is down.
+func (ci *CoreIpfs) checkMutable() error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	if ci.readOnly {
+		return ErrReadOnly
+	}
+	if !ci.available {
+		return ErrHotStorageUnavailable
+	}
+	return nil
+}
+
 // Remove removes a Cid from hot storage.
 func (ci *CoreIpfs) Remove(ctx context.Context, c cid.Cid) error {
-	log.Debugf("removing cid %s", c)
-	if err := ci.ipfs.Pin().Rm(ctx, path.IpfsPath(c), options.Pin.RmRecursive(true)); err != nil {
-		return fmt.Errorf("unpinning cid from ipfs node: %s", err)
+	if err := ci.checkMutable(); err != nil {
+		return err
+	}
+	logger(ctx).Debugf("removing cid %s", c)
+	pinned := ci.pinnedAs(c)
+	if len(pinned) == 0 {
+		// Let the node report that c isn't pinned.
+		pinned = []cid.Cid{c}
+	}
+	for _, pc := range pinned {
+		if err := ci.unpin(ctx, pc); err != nil {
+			return err
+		}
 	}
 	ci.l.Log(ctx, "Cid data was pinned in IPFS node.")
 	return nil
@@ -58,24 +229,49 @@ func (ci *CoreIpfs) Remove(ctx context.Context, c cid.Cid) error {
 
 // IsStored return if a particular Cid is stored.
 func (ci *CoreIpfs) IsStored(ctx context.Context, c cid.Cid) (bool, error) {
-	_, ok := ci.pinset[c]
-	return ok, nil
+	return len(ci.pinnedAs(c)) > 0, nil
 }
 
 // Add adds an io.Reader data as file in the IPFS node.
 func (ci *CoreIpfs) Add(ctx context.Context, r io.Reader) (cid.Cid, error) {
-	log.Debugf("adding data-stream...")
-	p, err := ci.ipfs.Unixfs().Add(ctx, ipfsfiles.NewReaderFile(r), options.Unixfs.Pin(false))
+	if err := ci.checkMutable(); err != nil {
+		return cid.Undef, err
+	}
+	logger(ctx).Debugf("adding data-stream...")
+	opts := []options.UnixfsAddOption{options.Unixfs.Pin(false)}
+	if ci.cfg.chunkSize > 0 {
+		opts = append(opts, options.Unixfs.Chunker(fmt.Sprintf("size-%d", ci.cfg.chunkSize)))
+	}
+	p, err := ci.ipfs.Unixfs().Add(ctx, ipfsfiles.NewReaderFile(r), opts...)
 	if err != nil {
 		return cid.Undef, fmt.Errorf("adding data to ipfs: %s", err)
 	}
-	log.Debugf("data-stream added with cid %s", p.Cid())
+	if ci.cfg.verifyAdd {
+		if err := ci.verifyLocal(ctx, p.Cid()); err != nil {
+			return cid.Undef, fmt.Errorf("verifying added data: %s", err)
+		}
+	}
+	logger(ctx).Debugf("data-stream added with cid %s", p.Cid())
 	return p.Cid(), nil
 }
 
+// AddWithSize is like Add, but also returns the cumulative size of the
+// added DAG, saving callers a separate stat call.
+func (ci *CoreIpfs) AddWithSize(ctx context.Context, r io.Reader) (cid.Cid, int64, error) {
+	c, err := ci.Add(ctx, r)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	size, err := statCid(ctx, ci.ipfs, c)
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("getting stats of cid %s: %s", c, err)
+	}
+	return c, int64(size), nil
+}
+
 // Get retrieves a cid from the IPFS node.
 func (ci *CoreIpfs) Get(ctx context.Context, c cid.Cid) (io.Reader, error) {
-	log.Debugf("getting cid %s", c)
+	logger(ctx).Debugf("getting cid %s", c)
 	n, err := ci.ipfs.Unixfs().Get(ctx, path.IpfsPath(c))
 	if err != nil {
 		return nil, fmt.Errorf("getting cid %s from ipfs: %s", c, err)
@@ -87,53 +283,607 @@ func (ci *CoreIpfs) Get(ctx context.Context, c cid.Cid) (io.Reader, error) {
 	return file, nil
 }
 
+// GetResult is the result of fetching a cid in GetMany.
+type GetResult struct {
+	Cid    cid.Cid
+	Reader io.Reader
+	Err    error
+}
+
+// GetMany retrieves multiple cids concurrently from the IPFS node. Results
+// are sent to the returned channel as they complete, not necessarily in the
+// same order as cids. The channel is closed when all cids were fetched, or
+// early if ctx is canceled.
+func (ci *CoreIpfs) GetMany(ctx context.Context, cids []cid.Cid) (<-chan GetResult, error) {
+	res := make(chan GetResult)
+	go func() {
+		defer close(res)
+
+		var wg sync.WaitGroup
+		rateLim := make(chan struct{}, getManyMaxParallel)
+	Loop:
+		for _, c := range cids {
+			select {
+			case <-ctx.Done():
+				break Loop
+			case rateLim <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(c cid.Cid) {
+				defer wg.Done()
+				defer func() { <-rateLim }()
+				r, err := ci.Get(ctx, c)
+				select {
+				case res <- GetResult{Cid: c, Reader: r, Err: err}:
+				case <-ctx.Done():
+				}
+			}(c)
+		}
+		wg.Wait()
+	}()
+	return res, nil
+}
+
+// GetBlock retrieves the raw data of a single block from the IPFS node.
+// Unlike Get, it doesn't interpret the data as UnixFS, so it should be used
+// for cids of arbitrary IPLD blocks (e.g: raw or dag-cbor). Store and Remove
+// work for any cid since they use the generic pin API.
+func (ci *CoreIpfs) GetBlock(ctx context.Context, c cid.Cid) ([]byte, error) {
+	logger(ctx).Debugf("getting block %s", c)
+	r, err := ci.ipfs.Block().Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return nil, fmt.Errorf("getting block %s from ipfs: %s", c, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading block %s: %s", c, err)
+	}
+	return b, nil
+}
+
+// GetNode retrieves the decoded IPLD node of c from the IPFS node, so callers
+// can inspect its links and type (e.g: a *dag.ProtoNode for UnixFS files,
+// directories and HAMT shards). Only the root block is fetched, but it's
+// fully held in memory, so large HAMT shards or nodes with many links may be
+// expensive.
+func (ci *CoreIpfs) GetNode(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	logger(ctx).Debugf("getting node %s", c)
+	n, err := ci.ipfs.Dag().Get(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("getting node %s from ipfs: %s", c, err)
+	}
+	return n, nil
+}
+
+// Size returns the cumulative size of the DAG rooted at c without pinning it.
+// If local is true, only blocks already available in the IPFS node are used
+// and ErrNotFound is returned if the root can't be resolved; otherwise the
+// node may fetch the root block from the network.
+func (ci *CoreIpfs) Size(ctx context.Context, c cid.Cid, local bool) (int64, error) {
+	ipfs := ci.ipfs
+	if local {
+		offline, err := ci.ipfs.WithOptions(options.Api.Offline(true))
+		if err != nil {
+			return 0, fmt.Errorf("creating offline api: %s", err)
+		}
+		ipfs = offline
+	}
+	size, err := statCid(ctx, ipfs, c)
+	if err != nil {
+		if local && isNotFoundErr(err) {
+			logger(ctx).Debugf("getting local stats of cid %s: %s", c, err)
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("getting stats of cid %s: %s", c, err)
+	}
+	return int64(size), nil
+}
+
+// Warm fetches all the blocks of the DAG rooted at c into the IPFS node
+// without pinning it, so subsequent Gets are served locally. Fetched blocks
+// are subject to the node garbage collection like any other unpinned data.
+func (ci *CoreIpfs) Warm(ctx context.Context, c cid.Cid) error {
+	logger(ctx).Debugf("warming cid %s", c)
+	fetched, missing, err := walkDag(ctx, ci.ipfs, c, nil)
+	if err != nil {
+		return fmt.Errorf("walking dag of cid %s: %s", c, err)
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d blocks of cid %s couldn't be fetched", missing, c)
+	}
+	logger(ctx).Debugf("warmed cid %s with %d blocks", c, fetched)
+	return nil
+}
+
+// IsComplete returns true if all the blocks of the DAG rooted at c are
+// available in the IPFS node, walking the DAG without fetching from the
+// network. It also returns the number of missing blocks; links of missing
+// blocks can't be followed, so it's a lower bound.
+func (ci *CoreIpfs) IsComplete(ctx context.Context, c cid.Cid) (bool, int, error) {
+	offline, err := ci.ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return false, 0, fmt.Errorf("creating offline api: %s", err)
+	}
+	_, missing, err := walkDag(ctx, offline, c, nil)
+	if err != nil {
+		return false, 0, fmt.Errorf("walking dag of cid %s: %s", c, err)
+	}
+	return missing == 0, missing, nil
+}
+
 // Store stores a Cid in the HotStorage. At the IPFS level, it also mark the Cid as pinned.
+// If the same content is already pinned with another cid version, that pin
+// is kept instead of pinning c too.
 func (ci *CoreIpfs) Store(ctx context.Context, c cid.Cid) (int, error) {
-	log.Debugf("fetching and pinning cid %s", c)
-	p := path.IpfsPath(c)
-	if err := ci.ipfs.Pin().Add(ctx, p, options.Pin.Recursive(true)); err != nil {
-		return 0, fmt.Errorf("pinning cid %s: %s", c, err)
+	if err := ci.checkMutable(); err != nil {
+		return 0, err
 	}
-	s, err := ci.ipfs.Object().Stat(ctx, p)
+	// The pin is done even if cached, since it's idempotent in the
+	// node and repairs a stale cache.
+	pc := c
+	if pinned := ci.pinnedAs(c); len(pinned) > 0 {
+		pc = pinned[0]
+	}
+	logger(ctx).Debugf("fetching and pinning cid %s", pc)
+	offline := ci.isOfflinePin(ctx)
+	pinAPI, err := ci.pinAPI(offline)
 	if err != nil {
-		return 0, fmt.Errorf("getting stats of cid %s: %s", c, err)
+		return 0, err
+	}
+	if err := pinAPI.Pin().Add(ctx, path.IpfsPath(pc), options.Pin.Recursive(true)); err != nil {
+		if offline && isNotFoundErr(err) {
+			return 0, ErrBlockNotLocal
+		}
+		return 0, fmt.Errorf("pinning cid %s: %s", pc, err)
 	}
 	ci.lock.Lock()
-	ci.pinset[c] = struct{}{}
+	ci.addPin(pc)
 	ci.lock.Unlock()
-	return s.CumulativeSize, nil
+	size, err := statCid(ctx, ci.ipfs, c)
+	if err != nil {
+		return 0, fmt.Errorf("getting stats of cid %s: %s", c, err)
+	}
+	return size, nil
 }
 
 // Replace replaces a stored Cid with other Cid.
 func (ci *CoreIpfs) Replace(ctx context.Context, c1 cid.Cid, c2 cid.Cid) (int, error) {
-	p1 := path.IpfsPath(c1)
-	p2 := path.IpfsPath(c2)
-	log.Debugf("updating pin from %s to %s", p1, p2)
-	if err := ci.ipfs.Pin().Update(ctx, p1, p2); err != nil {
-		return 0, fmt.Errorf("updating pin %s to %s: %s", c1, c2, err)
+	if err := ci.checkMutable(); err != nil {
+		return 0, err
+	}
+	logger(ctx).Debugf("updating pin from %s to %s", c1, c2)
+	from := ci.pinnedAs(c1)
+	cached := len(from) > 0
+	if !cached {
+		// The cache may be stale, so let the node report
+		// if c1 isn't pinned.
+		from = []cid.Cid{c1}
+	}
+	if pinsetKey(c1) != pinsetKey(c2) || !cached {
+		offline := ci.isOfflinePin(ctx)
+		pinAPI, err := ci.pinAPI(offline)
+		if err != nil {
+			return 0, err
+		}
+		if to := ci.pinnedAs(c2); len(to) == 0 {
+			if err := pinAPI.Pin().Update(ctx, path.IpfsPath(from[0]), path.IpfsPath(c2)); err != nil {
+				if offline && isNotFoundErr(err) {
+					return 0, ErrBlockNotLocal
+				}
+				return 0, fmt.Errorf("updating pin %s to %s: %s", from[0], c2, err)
+			}
+			ci.lock.Lock()
+			ci.removePin(from[0])
+			ci.addPin(c2)
+			ci.lock.Unlock()
+			from = from[1:]
+		} else {
+			// As in Store, c2 is pinned even if cached, so a stale
+			// cache doesn't leave neither c1 nor c2 pinned.
+			if err := pinAPI.Pin().Add(ctx, path.IpfsPath(to[0]), options.Pin.Recursive(true)); err != nil {
+				if offline && isNotFoundErr(err) {
+					return 0, ErrBlockNotLocal
+				}
+				return 0, fmt.Errorf("pinning cid %s: %s", to[0], err)
+			}
+			ci.lock.Lock()
+			ci.addPin(to[0])
+			ci.lock.Unlock()
+		}
+		// Other versions of c1, or all if c2 was already pinned.
+		for _, pc := range from {
+			if err := ci.unpin(ctx, pc); err != nil {
+				return 0, err
+			}
+		}
 	}
-	stat, err := ci.ipfs.Object().Stat(ctx, p2)
+	size, err := statCid(ctx, ci.ipfs, c2)
 	if err != nil {
 		return 0, fmt.Errorf("getting stats of cid %s: %s", c2, err)
 	}
+	return size, nil
+}
+
+// verifyLocal checks that the root block of c is available in the IPFS
+// node without fetching it from the network.
+func (ci *CoreIpfs) verifyLocal(ctx context.Context, c cid.Cid) error {
+	offline, err := ci.ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return fmt.Errorf("creating offline api: %s", err)
+	}
+	if _, err := offline.Block().Stat(ctx, path.IpfsPath(c)); err != nil {
+		return fmt.Errorf("root block of cid %s isn't available in the node: %s", c, err)
+	}
+	return nil
+}
+
+// statCid returns the cumulative size of the DAG rooted at c. For dag-pb
+// and raw nodes the size is calculated from the root block fetched with the
+// DAG API, which is equivalent to Object().Stat CumulativeSize. Other
+// codecs, or any failure, fallback to the deprecated Object API.
+func statCid(ctx context.Context, ipfs iface.CoreAPI, c cid.Cid) (int, error) {
+	n, err := ipfs.Dag().Get(ctx, c)
+	if err == nil {
+		switch n.(type) {
+		case *dag.ProtoNode, *dag.RawNode:
+			size, err := n.Size()
+			if err == nil {
+				return int(size), nil
+			}
+		}
+	}
+	logger(ctx).Debugf("falling back to object stat for cid %s", c)
+	s, err := ipfs.Object().Stat(ctx, path.IpfsPath(c))
+	if err != nil {
+		return 0, err
+	}
+	return s.CumulativeSize, nil
+}
+
+// CidSize is a cid with its cumulative DAG size.
+type CidSize struct {
+	Cid  cid.Cid
+	Size int64
+}
+
+// TopLargest returns the n largest cids in the pinset, sorted by size in
+// descending order. Sizes are stated from the IPFS node, so the cost grows
+// with the pinset size.
+func (ci *CoreIpfs) TopLargest(ctx context.Context, n int) ([]CidSize, error) {
+	if n <= 0 {
+		return nil, nil
+	}
 	ci.lock.Lock()
-	delete(ci.pinset, c1)
-	ci.pinset[c2] = struct{}{}
+	pinned := make([]cid.Cid, 0, len(ci.pinset))
+	for _, pcs := range ci.pinset {
+		// Every version has the same size.
+		pinned = append(pinned, pcs[0])
+	}
 	ci.lock.Unlock()
 
-	return stat.CumulativeSize, nil
+	sizes := make([]CidSize, 0, len(pinned))
+	for _, c := range pinned {
+		size, err := statCid(ctx, ci.ipfs, c)
+		if err != nil {
+			return nil, fmt.Errorf("getting stats of cid %s: %s", c, err)
+		}
+		sizes = append(sizes, CidSize{Cid: c, Size: int64(size)})
+	}
+	return topLargest(sizes, n), nil
 }
 
-func (ci *CoreIpfs) fillPinsetCache(ctx context.Context) error {
-	pins, err := ci.ipfs.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+// topLargest returns the n largest elements of sizes, sorted by size in
+// descending order. It keeps a min-heap of at most n elements, so the
+// smallest selected element is popped first.
+func topLargest(sizes []CidSize, n int) []CidSize {
+	h := &cidSizeHeap{}
+	for _, cs := range sizes {
+		if h.Len() < n {
+			heap.Push(h, cs)
+		} else if cs.Size > (*h)[0].Size {
+			(*h)[0] = cs
+			heap.Fix(h, 0)
+		}
+	}
+
+	res := make([]CidSize, h.Len())
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = heap.Pop(h).(CidSize)
+	}
+	return res
+}
+
+// CidDiagnostics contains everything known about a cid in hot storage.
+type CidDiagnostics struct {
+	Cid cid.Cid
+	// Cached is true if the cid is in the pinset cache.
+	Cached bool
+	// NodePinned is true if the cid is pinned in the IPFS node,
+	// and NodePinReason explains how.
+	NodePinned    bool
+	NodePinReason string
+	// RootBlockLocal is true if the root block is available in the
+	// IPFS node without fetching it from the network.
+	RootBlockLocal bool
+	// Size is the cumulative DAG size, calculated from local blocks.
+	Size int64
+	// Errors contains the errors of checks that couldn't be completed,
+	// keyed by check name. The corresponding fields have zero values.
+	Errors map[string]string
+}
+
+// Diagnose returns diagnostic information about a cid. A failing check
+// doesn't abort the rest; its error is reported in CidDiagnostics.Errors.
+// All checks avoid fetching data from the network.
+func (ci *CoreIpfs) Diagnose(ctx context.Context, c cid.Cid) (CidDiagnostics, error) {
+	d := CidDiagnostics{
+		Cid:    c,
+		Errors: map[string]string{},
+	}
+
+	d.Cached = len(ci.pinnedAs(c)) > 0
+
+	offline, err := ci.ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return CidDiagnostics{}, fmt.Errorf("creating offline api: %s", err)
+	}
+	p := path.IpfsPath(c)
+	reason, pinned, err := offline.Pin().IsPinned(ctx, p)
+	if err != nil {
+		d.Errors["node-pin"] = err.Error()
+	} else {
+		d.NodePinned = pinned
+		d.NodePinReason = reason
+	}
+	if _, err := offline.Block().Stat(ctx, p); err != nil {
+		d.Errors["root-block"] = err.Error()
+	} else {
+		d.RootBlockLocal = true
+	}
+	size, err := statCid(ctx, offline, c)
+	if err != nil {
+		d.Errors["size"] = err.Error()
+	} else {
+		d.Size = int64(size)
+	}
+	return d, nil
+}
+
+// UniqueSize returns the total size of the blocks reachable from c which
+// aren't reachable from any other cid in the pinset, i.e: the space that
+// would be freed if only c was unpinned and the node garbage collected.
+// It walks the DAGs of all pinned cids from local blocks, so it's expensive;
+// results are cached until the pinset changes.
+func (ci *CoreIpfs) UniqueSize(ctx context.Context, c cid.Cid) (int64, error) {
+	key := pinsetKey(c)
+	ci.lock.Lock()
+	if size, ok := ci.uniqueSizes[key]; ok {
+		ci.lock.Unlock()
+		return size, nil
+	}
+	version := ci.pinsetVersion
+	others := make([]cid.Cid, 0, len(ci.pinset))
+	for pk, pcs := range ci.pinset {
+		if pk != key {
+			others = append(others, pcs[0])
+		}
+	}
+	ci.lock.Unlock()
+
+	offline, err := ci.ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return 0, fmt.Errorf("creating offline api: %s", err)
+	}
+	blocks := map[cid.Cid]int64{}
+	_, missing, err := walkDag(ctx, offline, c, func(n ipld.Node) {
+		blocks[n.Cid()] = int64(len(n.RawData()))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walking dag of cid %s: %s", c, err)
+	}
+	if missing > 0 {
+		return 0, fmt.Errorf("dag of cid %s isn't complete in the node, %d blocks missing", c, missing)
+	}
+	for _, pc := range others {
+		_, missing, err := walkDag(ctx, offline, pc, func(n ipld.Node) {
+			delete(blocks, n.Cid())
+		})
+		if err != nil {
+			return 0, fmt.Errorf("walking dag of cid %s: %s", pc, err)
+		}
+		// Blocks shared under the missing ones would be
+		// wrongly counted as unique.
+		if missing > 0 {
+			return 0, fmt.Errorf("dag of cid %s isn't complete in the node, %d blocks missing", pc, missing)
+		}
+	}
+	var size int64
+	for _, s := range blocks {
+		size += s
+	}
+
+	ci.lock.Lock()
+	if ci.pinsetVersion == version {
+		if ci.uniqueSizes == nil {
+			ci.uniqueSizes = map[cid.Cid]int64{}
+		}
+		ci.uniqueSizes[key] = size
+	}
+	ci.lock.Unlock()
+	return size, nil
+}
+
+// Discrepancy describes a cid whose state differs between the pinset
+// cache and the IPFS node.
+type Discrepancy struct {
+	Cid cid.Cid
+	// InCache is true if the cid is in the pinset cache.
+	InCache bool
+	// InNode is true if the cid is recursively pinned in the IPFS node.
+	InNode bool
+}
+
+// SelfCheck compares the pinset cache with the recursive pins of the IPFS
+// node, and returns the cids present in one but not the other. Pin mutations
+// running concurrently may be reported as transient discrepancies.
+func (ci *CoreIpfs) SelfCheck(ctx context.Context) ([]Discrepancy, error) {
+	pins, err := ci.NodePins(ctx)
 	if err != nil {
-		return fmt.Errorf("getting pins from IPFS: %s", err)
+		return nil, err
 	}
+	node := make(map[cid.Cid]struct{}, len(pins))
+	for _, c := range pins {
+		node[c] = struct{}{}
+	}
+
 	ci.lock.Lock()
 	defer ci.lock.Unlock()
-	ci.pinset = make(map[cid.Cid]struct{}, len(pins))
+	cache := make(map[cid.Cid]struct{}, len(ci.pinset))
+	for _, pcs := range ci.pinset {
+		for _, c := range pcs {
+			cache[c] = struct{}{}
+		}
+	}
+	var res []Discrepancy
+	for c := range cache {
+		if _, ok := node[c]; !ok {
+			res = append(res, Discrepancy{Cid: c, InCache: true})
+		}
+	}
+	for c := range node {
+		if _, ok := cache[c]; !ok {
+			res = append(res, Discrepancy{Cid: c, InNode: true})
+		}
+	}
+	return res, nil
+}
+
+// Reload refreshes the pinset cache from the IPFS node. It's useful after
+// the node pinset was modified out-of-band, without restarting.
+func (ci *CoreIpfs) Reload(ctx context.Context) error {
+	ci.lock.Lock()
+	before := len(ci.pinset)
+	ci.lock.Unlock()
+
+	if err := ci.fillPinsetCache(ctx); err != nil {
+		return err
+	}
+
+	ci.lock.Lock()
+	after := len(ci.pinset)
+	ci.lock.Unlock()
+	logger(ctx).Infof("pinset cache reloaded, %d entries before and %d after", before, after)
+	return nil
+}
+
+// NodePins returns the recursive pins of the IPFS node. Contrary to IsStored,
+// it doesn't use the pinset cache, so it reflects the real node state.
+func (ci *CoreIpfs) NodePins(ctx context.Context) ([]cid.Cid, error) {
+	pins, err := ci.ipfs.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+	if err != nil {
+		return nil, fmt.Errorf("getting pins from IPFS: %s", err)
+	}
+	var res []cid.Cid
 	for p := range pins {
-		ci.pinset[p.Path().Cid()] = struct{}{}
+		if p.Err() != nil {
+			return nil, fmt.Errorf("listing pins from IPFS: %s", p.Err())
+		}
+		res = append(res, p.Path().Cid())
 	}
+	return res, nil
+}
+
+func (ci *CoreIpfs) fillPinsetCache(ctx context.Context) error {
+	pins, err := ci.NodePins(ctx)
+	if err != nil {
+		return err
+	}
+	pinset := make(map[cid.Cid][]cid.Cid, len(pins))
+	for _, c := range pins {
+		key := pinsetKey(c)
+		pinset[key] = append(pinset[key], c)
+	}
+	ci.lock.Lock()
+	ci.pinset = pinset
+	ci.pinsetChanged()
+	ci.lock.Unlock()
 	return nil
 }
+
+// pinsetChanged invalidates state derived from the pinset. It must be
+// called with ci.lock held.
+func (ci *CoreIpfs) pinsetChanged() {
+	ci.pinsetVersion++
+	ci.uniqueSizes = nil
+}
+
+// pinnedAs returns the exact cids pinned in the node for the content of c,
+// which may have a different version than c.
+func (ci *CoreIpfs) pinnedAs(c cid.Cid) []cid.Cid {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	return append([]cid.Cid(nil), ci.pinset[pinsetKey(c)]...)
+}
+
+// unpin unpins the exact cid c from the node and the pinset cache.
+func (ci *CoreIpfs) unpin(ctx context.Context, c cid.Cid) error {
+	if err := ci.ipfs.Pin().Rm(ctx, path.IpfsPath(c), options.Pin.RmRecursive(true)); err != nil {
+		return fmt.Errorf("unpinning cid %s from ipfs node: %s", c, err)
+	}
+	ci.lock.Lock()
+	ci.removePin(c)
+	ci.lock.Unlock()
+	return nil
+}
+
+// addPin adds the exact cid c to the pinset cache. It must be called
+// with ci.lock held.
+func (ci *CoreIpfs) addPin(c cid.Cid) {
+	key := pinsetKey(c)
+	for _, pc := range ci.pinset[key] {
+		if pc == c {
+			return
+		}
+	}
+	ci.pinset[key] = append(ci.pinset[key], c)
+	ci.pinsetChanged()
+}
+
+// removePin removes the exact cid c from the pinset cache. It must be
+// called with ci.lock held.
+func (ci *CoreIpfs) removePin(c cid.Cid) {
+	key := pinsetKey(c)
+	var pinned []cid.Cid
+	for _, pc := range ci.pinset[key] {
+		if pc != c {
+			pinned = append(pinned, pc)
+		}
+	}
+	if len(pinned) == 0 {
+		delete(ci.pinset, key)
+	} else {
+		ci.pinset[key] = pinned
+	}
+	ci.pinsetChanged()
+}
+
+// pinsetKey normalizes c to CIDv1, so the same content addressed as CIDv0
+// or CIDv1 maps to a single pinset entry.
+func pinsetKey(c cid.Cid) cid.Cid {
+	return cid.NewCidV1(c.Type(), c.Hash())
+}
+
+// cidSizeHeap is a min-heap of CidSize ordered by size.
+type cidSizeHeap []CidSize
+
+func (h cidSizeHeap) Len() int            { return len(h) }
+func (h cidSizeHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h cidSizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cidSizeHeap) Push(x interface{}) { *h = append(*h, x.(CidSize)) }
+func (h *cidSizeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
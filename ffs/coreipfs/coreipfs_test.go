@@ -0,0 +1,909 @@
+package coreipfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipfsfiles "github.com/ipfs/go-ipfs-files"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/hamt"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"github.com/textileio/powergate/ffs"
+	"github.com/textileio/powergate/ffs/joblogger"
+	"github.com/textileio/powergate/tests"
+	"github.com/textileio/powergate/util"
+)
+
+func TestPinsetKey(t *testing.T) {
+	t.Parallel()
+
+	v0, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	v1 := cid.NewCidV1(v0.Type(), v0.Hash())
+	require.NotEqual(t, v0, v1)
+
+	require.Equal(t, pinsetKey(v0), pinsetKey(v1))
+	require.Equal(t, v1, pinsetKey(v0))
+
+	pinset := map[cid.Cid]struct{}{pinsetKey(v0): {}}
+	_, ok := pinset[pinsetKey(v1)]
+	require.True(t, ok)
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(nil, nil, WithChunkSize(maxChunkSize+1))
+	require.Error(t, err)
+	_, err = New(nil, nil, WithChunkSize(-1))
+	require.Error(t, err)
+}
+
+func TestOfflinePinOverride(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ci := &CoreIpfs{}
+	require.False(t, ci.isOfflinePin(ctx))
+	require.True(t, ci.isOfflinePin(WithOfflinePin(ctx, true)))
+
+	ci = &CoreIpfs{cfg: config{offlinePin: true}}
+	require.True(t, ci.isOfflinePin(ctx))
+	require.False(t, ci.isOfflinePin(WithOfflinePin(ctx, false)))
+}
+
+func TestIsNotFoundErr(t *testing.T) {
+	t.Parallel()
+
+	require.True(t, isNotFoundErr(errors.New("pin: blockstore: block not found")))
+	require.True(t, isNotFoundErr(errors.New("merkledag: not found")))
+	require.False(t, isNotFoundErr(errors.New("ipns name not found")))
+	require.False(t, isNotFoundErr(errors.New("404 page not found")))
+}
+
+func TestTopLargestSelection(t *testing.T) {
+	t.Parallel()
+
+	var sizes []CidSize
+	for _, s := range []int64{30, 10, 50, 20, 40} {
+		sizes = append(sizes, CidSize{Size: s})
+	}
+	tests := []struct {
+		n        int
+		expected []int64
+	}{
+		{n: 1, expected: []int64{50}},
+		{n: 2, expected: []int64{50, 40}},
+		{n: 5, expected: []int64{50, 40, 30, 20, 10}},
+		{n: 8, expected: []int64{50, 40, 30, 20, 10}},
+	}
+	for _, tt := range tests {
+		res := topLargest(sizes, tt.n)
+		got := make([]int64, len(res))
+		for i, cs := range res {
+			got[i] = cs.Size
+		}
+		require.Equal(t, tt.expected, got, "n=%d", tt.n)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	ci := &CoreIpfs{available: true}
+	ci.SetReadOnly(true)
+	require.True(t, ci.IsReadOnly())
+
+	_, err = ci.Add(ctx, bytes.NewReader(nil))
+	require.Equal(t, ErrReadOnly, err)
+	_, err = ci.Store(ctx, c)
+	require.Equal(t, ErrReadOnly, err)
+	_, err = ci.Replace(ctx, c, c)
+	require.Equal(t, ErrReadOnly, err)
+	err = ci.Remove(ctx, c)
+	require.Equal(t, ErrReadOnly, err)
+
+	ci.SetReadOnly(false)
+	require.False(t, ci.IsReadOnly())
+	require.NoError(t, ci.checkMutable())
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	t.Parallel()
+
+	key := &stubKeyAPI{}
+	ci := &CoreIpfs{
+		ipfs:      &stubKeyCoreAPI{key: key},
+		cfg:       config{monitorInterval: time.Second},
+		available: true,
+		ctx:       context.Background(),
+	}
+	ci.checkConnectivity()
+	require.True(t, ci.IsAvailable())
+
+	key.err = errors.New("connection refused")
+	ci.checkConnectivity()
+	require.False(t, ci.IsAvailable())
+	require.Equal(t, ErrHotStorageUnavailable, ci.checkMutable())
+
+	key.err = nil
+	ci.checkConnectivity()
+	require.True(t, ci.IsAvailable())
+	require.NoError(t, ci.checkMutable())
+}
+
+func TestSizeLocalErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	ipfs := &stubDagCoreAPI{err: errors.New("merkledag: not found")}
+	ci := &CoreIpfs{ipfs: ipfs}
+	_, err = ci.Size(ctx, c, true)
+	require.Equal(t, ErrNotFound, err)
+
+	// Other errors, e.g: the node being down, aren't ErrNotFound.
+	ipfs.err = errors.New("connection refused")
+	_, err = ci.Size(ctx, c, true)
+	require.Error(t, err)
+	require.NotEqual(t, ErrNotFound, err)
+}
+
+func TestIsCompleteErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	ipfs := &stubDagCoreAPI{err: errors.New("merkledag: not found")}
+	ci := &CoreIpfs{ipfs: ipfs}
+	complete, missing, err := ci.IsComplete(ctx, c)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, 1, missing)
+
+	// Other errors, e.g: the node being down, aren't missing blocks.
+	ipfs.err = errors.New("connection refused")
+	_, _, err = ci.IsComplete(ctx, c)
+	require.Error(t, err)
+}
+
+// stubDagCoreAPI is a CoreAPI whose Dag and Object APIs fail with err.
+type stubDagCoreAPI struct {
+	iface.CoreAPI
+	err error
+}
+
+func (a *stubDagCoreAPI) WithOptions(...options.ApiOption) (iface.CoreAPI, error) {
+	return a, nil
+}
+
+func (a *stubDagCoreAPI) Dag() iface.APIDagService {
+	return &stubDagAPI{err: a.err}
+}
+
+func (a *stubDagCoreAPI) Object() iface.ObjectAPI {
+	return &stubObjectAPI{err: a.err}
+}
+
+type stubDagAPI struct {
+	iface.APIDagService
+	err error
+}
+
+func (d *stubDagAPI) Get(context.Context, cid.Cid) (ipld.Node, error) {
+	return nil, d.err
+}
+
+func (d *stubDagAPI) GetMany(_ context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	ch := make(chan *ipld.NodeOption, len(cids))
+	for range cids {
+		ch <- &ipld.NodeOption{Err: d.err}
+	}
+	close(ch)
+	return ch
+}
+
+type stubObjectAPI struct {
+	iface.ObjectAPI
+	err error
+}
+
+func (o *stubObjectAPI) Stat(context.Context, path.Path) (*iface.ObjectStat, error) {
+	return nil, o.err
+}
+
+// stubKeyCoreAPI is a CoreAPI which only implements Key.
+type stubKeyCoreAPI struct {
+	iface.CoreAPI
+	key *stubKeyAPI
+}
+
+func (a *stubKeyCoreAPI) Key() iface.KeyAPI {
+	return a.key
+}
+
+// stubKeyAPI is a KeyAPI whose Self returns err.
+type stubKeyAPI struct {
+	iface.KeyAPI
+	err error
+}
+
+func (k *stubKeyAPI) Self(context.Context) (iface.Key, error) {
+	return nil, k.err
+}
+
+func TestStoreInBackground(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	release := make(chan struct{})
+	pin := &stubAddPinAPI{add: func(context.Context) error {
+		<-release
+		return errors.New("no providers")
+	}}
+	cctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	close(finished)
+	api := &stubPinCoreAPI{pin: pin}
+	ci := &CoreIpfs{
+		ipfs:      api,
+		available: true,
+		pinset:    map[cid.Cid][]cid.Cid{},
+		fetching:  map[cid.Cid]struct{}{},
+		fetchErrs: map[cid.Cid]error{},
+		ctx:       cctx,
+		cancel:    cancel,
+		finished:  finished,
+	}
+
+	// A failed background pin is recorded.
+	started, err := ci.StoreInBackground(ctx, c)
+	require.NoError(t, err)
+	require.True(t, started)
+	require.True(t, ci.IsFetching(c))
+	started, err = ci.StoreInBackground(ctx, c)
+	require.NoError(t, err)
+	require.True(t, started)
+	close(release)
+	require.Eventually(t, func() bool { return !ci.IsFetching(c) }, time.Second, time.Millisecond*10)
+	require.Error(t, ci.FetchError(c))
+	stored, err := ci.IsStored(ctx, c)
+	require.NoError(t, err)
+	require.False(t, stored)
+
+	// The offline pin override of the caller is kept.
+	pin.add = func(context.Context) error {
+		return errors.New("blockstore: block not found")
+	}
+	started, err = ci.StoreInBackground(WithOfflinePin(ctx, true), c)
+	require.NoError(t, err)
+	require.True(t, started)
+	require.Eventually(t, func() bool { return !ci.IsFetching(c) }, time.Second, time.Millisecond*10)
+	require.True(t, api.offline)
+	require.Equal(t, ErrBlockNotLocal, ci.FetchError(c))
+
+	// Close cancels and waits for background pins, which
+	// aren't recorded as failed.
+	pin.add = func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	started, err = ci.StoreInBackground(ctx, c)
+	require.NoError(t, err)
+	require.True(t, started)
+	require.NoError(t, ci.FetchError(c))
+	require.NoError(t, ci.Close())
+	require.False(t, ci.IsFetching(c))
+	require.NoError(t, ci.FetchError(c))
+	_, err = ci.StoreInBackground(ctx, c)
+	require.Error(t, err)
+}
+
+// stubAddPinAPI is a PinAPI whose Add calls add.
+type stubAddPinAPI struct {
+	iface.PinAPI
+	add func(context.Context) error
+}
+
+func (p *stubAddPinAPI) Add(ctx context.Context, _ path.Path, _ ...options.PinAddOption) error {
+	return p.add(ctx)
+}
+
+// stubPinCoreAPI is a CoreAPI which only implements Pin, and records
+// if the offline option was used.
+type stubPinCoreAPI struct {
+	iface.CoreAPI
+	pin     iface.PinAPI
+	offline bool
+}
+
+func (a *stubPinCoreAPI) WithOptions(opts ...options.ApiOption) (iface.CoreAPI, error) {
+	settings, err := options.ApiOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	a.offline = settings.Offline
+	return a, nil
+}
+
+func (a *stubPinCoreAPI) Pin() iface.PinAPI {
+	return a.pin
+}
+
+// stubRmPinAPI is a PinAPI whose Rm returns err.
+type stubRmPinAPI struct {
+	iface.PinAPI
+	err error
+}
+
+func (p *stubRmPinAPI) Rm(context.Context, path.Path, ...options.PinRmOption) error {
+	return p.err
+}
+
+func TestRemoveExpiredKeepsTrackedCids(t *testing.T) {
+	t.Parallel()
+
+	c, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	ci := &CoreIpfs{
+		ctx:          context.Background(),
+		ipnsNames:    map[string]cid.Cid{"name": c},
+		ipnsExpiring: map[cid.Cid]time.Time{c: time.Now().Add(-time.Minute)},
+	}
+	// The name points again to the expiring cid, so it isn't removed.
+	ci.removeExpired()
+	require.Empty(t, ci.ipnsExpiring)
+}
+
+func TestRemoveExpiredDropsUnpinned(t *testing.T) {
+	t.Parallel()
+
+	c, err := util.CidFromString("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+	pin := &stubRmPinAPI{err: errors.New("connection refused")}
+	ci := &CoreIpfs{
+		ipfs:         &stubPinCoreAPI{pin: pin},
+		cfg:          config{ipnsInterval: time.Second},
+		available:    true,
+		ctx:          context.Background(),
+		ipnsNames:    map[string]cid.Cid{},
+		ipnsExpiring: map[cid.Cid]time.Time{c: time.Now().Add(-time.Minute)},
+	}
+	// Failed removals are retried.
+	ci.removeExpired()
+	require.Len(t, ci.ipnsExpiring, 1)
+
+	// Already unpinned cids are considered removed.
+	pin.err = errors.New("not pinned or pinned indirectly")
+	ci.removeExpired()
+	require.Empty(t, ci.ipnsExpiring)
+}
+
+func TestFollowSharedCid(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t, WithIPNSFollow(time.Hour, 0))
+
+	c1, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	c2, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	name1 := publishIPNS(ctx, t, ipfs, "name1", c1)
+	name2 := publishIPNS(ctx, t, ipfs, "name2", c1)
+	_, _, err = ci.StoreIPNS(ctx, name1)
+	require.NoError(t, err)
+	_, _, err = ci.StoreIPNS(ctx, name2)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, c1)
+
+	// name1 moves to c2, but c1 is kept since name2 points to it.
+	publishIPNS(ctx, t, ipfs, "name1", c2)
+	ci.followNames()
+	ci.removeExpired()
+	require.Empty(t, ci.ipnsExpiring)
+	requireNodePins(ctx, t, ci, c1, c2)
+
+	// name2 moves to c2 too, so c1 is removed.
+	publishIPNS(ctx, t, ipfs, "name2", c2)
+	c, changed, err := ci.RefreshIPNS(ctx, name2)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, c2, c)
+	requireNodePins(ctx, t, ci, c2)
+
+	// An expiring cid which was already unpinned is dropped.
+	ci.ipnsExpiring[c1] = time.Now()
+	ci.removeExpired()
+	require.Empty(t, ci.ipnsExpiring)
+	requireNodePins(ctx, t, ci, c2)
+}
+
+func TestStoreIPNSTracked(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t)
+
+	c1, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	c2, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	name := publishIPNS(ctx, t, ipfs, "name", c1)
+	_, _, err = ci.StoreIPNS(ctx, name)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, c1)
+
+	// Storing a tracked name which moved removes the previous cid.
+	publishIPNS(ctx, t, ipfs, "name", c2)
+	c, _, err := ci.StoreIPNS(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, c2, c)
+	requireNodePins(ctx, t, ci, c2)
+
+	err = ci.UntrackIPNS(ctx, name)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci)
+	err = ci.UntrackIPNS(ctx, name)
+	require.Error(t, err)
+	_, _, err = ci.RefreshIPNS(ctx, name)
+	require.Error(t, err)
+}
+
+// publishIPNS publishes c with the key named keyName, creating the
+// key if needed, and returns the IPNS name.
+func publishIPNS(ctx context.Context, t *testing.T, ipfs iface.CoreAPI, keyName string, c cid.Cid) string {
+	keys, err := ipfs.Key().List(ctx)
+	require.NoError(t, err)
+	exists := false
+	for _, k := range keys {
+		if k.Name() == keyName {
+			exists = true
+		}
+	}
+	if !exists {
+		_, err = ipfs.Key().Generate(ctx, keyName)
+		require.NoError(t, err)
+	}
+	e, err := ipfs.Name().Publish(ctx, path.IpfsPath(c), options.Name.Key(keyName), options.Name.AllowOffline(true))
+	require.NoError(t, err)
+	return e.Name()
+}
+
+func TestFollowNamesConcurrentRefresh(t *testing.T) {
+	t.Parallel()
+
+	var cids []cid.Cid
+	for i := 0; i < 3; i++ {
+		pref := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}
+		c, err := pref.Sum(randomBytes(t, 100))
+		require.NoError(t, err)
+		cids = append(cids, c)
+	}
+	c1, c2, c3 := cids[0], cids[1], cids[2]
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	ipfs := &stubFollowCoreAPI{to: c2}
+	ci := &CoreIpfs{
+		ipfs:         ipfs,
+		l:            joblogger.New(ds),
+		cfg:          config{ipnsInterval: time.Minute},
+		available:    true,
+		pinset:       map[cid.Cid][]cid.Cid{},
+		ipnsNames:    map[string]cid.Cid{"name": c1},
+		ipnsExpiring: map[cid.Cid]time.Time{},
+		ctx:          context.Background(),
+	}
+	// The name is refreshed to c3 while the follower resolves it to c2.
+	ipfs.onResolve = func() {
+		ci.lock.Lock()
+		ci.ipnsNames["name"] = c3
+		ci.lock.Unlock()
+	}
+
+	ci.followNames()
+	require.Equal(t, c3, ci.ipnsNames["name"])
+	require.Empty(t, ci.ipnsExpiring)
+	require.Equal(t, []cid.Cid{c2}, ipfs.removed)
+	stored, err := ci.IsStored(context.Background(), c2)
+	require.NoError(t, err)
+	require.False(t, stored)
+}
+
+// stubFollowCoreAPI is a CoreAPI which resolves every IPNS name to the
+// cid to, and has every block available.
+type stubFollowCoreAPI struct {
+	iface.CoreAPI
+	to        cid.Cid
+	onResolve func()
+	removed   []cid.Cid
+}
+
+func (a *stubFollowCoreAPI) Name() iface.NameAPI {
+	return &stubNameAPI{api: a}
+}
+
+func (a *stubFollowCoreAPI) ResolvePath(_ context.Context, p path.Path) (path.Resolved, error) {
+	return p.(path.Resolved), nil
+}
+
+func (a *stubFollowCoreAPI) Pin() iface.PinAPI {
+	return &stubFollowPinAPI{api: a}
+}
+
+func (a *stubFollowCoreAPI) Dag() iface.APIDagService {
+	return &stubRawDagAPI{}
+}
+
+type stubNameAPI struct {
+	iface.NameAPI
+	api *stubFollowCoreAPI
+}
+
+func (n *stubNameAPI) Resolve(context.Context, string, ...options.NameResolveOption) (path.Path, error) {
+	n.api.onResolve()
+	return path.IpfsPath(n.api.to), nil
+}
+
+type stubFollowPinAPI struct {
+	iface.PinAPI
+	api *stubFollowCoreAPI
+}
+
+func (p *stubFollowPinAPI) Add(context.Context, path.Path, ...options.PinAddOption) error {
+	return nil
+}
+
+func (p *stubFollowPinAPI) Rm(_ context.Context, pth path.Path, _ ...options.PinRmOption) error {
+	p.api.removed = append(p.api.removed, pth.(path.Resolved).Cid())
+	return nil
+}
+
+// stubRawDagAPI is a DAG API which returns an empty raw node for any cid.
+type stubRawDagAPI struct {
+	iface.APIDagService
+}
+
+func (d *stubRawDagAPI) Get(context.Context, cid.Cid) (ipld.Node, error) {
+	return dag.NewRawNode(nil), nil
+}
+
+func TestWatchIPNSClose(t *testing.T) {
+	t.Parallel()
+
+	cctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	close(finished)
+	ci := &CoreIpfs{ctx: cctx, cancel: cancel, finished: finished}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ci.WatchIPNS(context.Background(), make(chan IPNSFollow))
+	}()
+	require.Eventually(t, func() bool {
+		ci.lock.Lock()
+		defer ci.lock.Unlock()
+		return len(ci.ipnsWatchers) == 1
+	}, time.Second, time.Millisecond*10)
+	require.NoError(t, ci.Close())
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("watcher wasn't closed")
+	}
+	require.Error(t, ci.WatchIPNS(context.Background(), make(chan IPNSFollow)))
+}
+
+func TestStoreCidVersions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t)
+
+	v0, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	v1 := cid.NewCidV1(v0.Type(), v0.Hash())
+
+	// Storing the same content with both versions pins it once.
+	_, err = ci.Store(ctx, v0)
+	require.NoError(t, err)
+	_, err = ci.Store(ctx, v1)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, v0)
+	stored, err := ci.IsStored(ctx, v1)
+	require.NoError(t, err)
+	require.True(t, stored)
+
+	// Removing with the other version unpins the real pin.
+	err = ci.Remove(context.WithValue(ctx, ffs.CtxStorageCid, v1), v1)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci)
+	stored, err = ci.IsStored(ctx, v0)
+	require.NoError(t, err)
+	require.False(t, stored)
+
+	// If both versions were pinned out-of-band, Remove unpins both.
+	require.NoError(t, ipfs.Pin().Add(ctx, path.IpfsPath(v0)))
+	require.NoError(t, ipfs.Pin().Add(ctx, path.IpfsPath(v1)))
+	require.NoError(t, ci.Reload(ctx))
+	requireNodePins(ctx, t, ci, v0, v1)
+	err = ci.Remove(context.WithValue(ctx, ffs.CtxStorageCid, v0), v0)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci)
+	stored, err = ci.IsStored(ctx, v1)
+	require.NoError(t, err)
+	require.False(t, stored)
+}
+
+func TestOfflinePinOnly(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, _ := createCoreIpfs(t, WithOfflinePinOnly(true))
+
+	// The cid of data that was never added to the node.
+	pref := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}
+	c, err := pref.Sum(randomBytes(t, 1000))
+	require.NoError(t, err)
+	_, err = ci.Store(ctx, c)
+	require.Equal(t, ErrBlockNotLocal, err)
+	requireNodePins(ctx, t, ci)
+
+	local, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	_, err = ci.Store(ctx, local)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, local)
+}
+
+func TestStaleCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t)
+
+	c1, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+	c2, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+
+	// Store repins a cached cid which was unpinned out-of-band.
+	_, err = ci.Store(ctx, c1)
+	require.NoError(t, err)
+	require.NoError(t, ipfs.Pin().Rm(ctx, path.IpfsPath(c1)))
+	_, err = ci.Store(ctx, c1)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, c1)
+
+	// Replace lets the node decide if a cid missing in the cache is pinned.
+	require.NoError(t, ipfs.Pin().Rm(ctx, path.IpfsPath(c1)))
+	require.NoError(t, ci.Reload(ctx))
+	require.NoError(t, ipfs.Pin().Add(ctx, path.IpfsPath(c1)))
+	_, err = ci.Replace(ctx, c1, c2)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, c2)
+	_, err = ci.Replace(ctx, c1, c2)
+	require.Error(t, err)
+
+	// Replace repins a cached c2 which was unpinned out-of-band
+	// before unpinning c1.
+	_, err = ci.Store(ctx, c1)
+	require.NoError(t, err)
+	require.NoError(t, ipfs.Pin().Rm(ctx, path.IpfsPath(c2)))
+	_, err = ci.Replace(ctx, c1, c2)
+	require.NoError(t, err)
+	requireNodePins(ctx, t, ci, c2)
+}
+
+func TestStoreFailsAfterPin(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t)
+
+	c, err := ci.Add(ctx, bytes.NewReader(randomBytes(t, 1000)))
+	require.NoError(t, err)
+
+	// The ctx is canceled right after pinning, so getting
+	// the stats fails but the cache still has the pin.
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ci.ipfs = &cancelAfterPinAPI{CoreAPI: ipfs, cancel: cancel}
+	_, err = ci.Store(sctx, c)
+	require.Error(t, err)
+	stored, err := ci.IsStored(ctx, c)
+	require.NoError(t, err)
+	require.True(t, stored)
+	requireNodePins(ctx, t, ci, c)
+}
+
+// cancelAfterPinAPI is a CoreAPI which calls cancel after each pin.
+type cancelAfterPinAPI struct {
+	iface.CoreAPI
+	cancel context.CancelFunc
+}
+
+func (a *cancelAfterPinAPI) Pin() iface.PinAPI {
+	return &cancelAfterPinPinAPI{PinAPI: a.CoreAPI.Pin(), cancel: a.cancel}
+}
+
+type cancelAfterPinPinAPI struct {
+	iface.PinAPI
+	cancel context.CancelFunc
+}
+
+func (p *cancelAfterPinPinAPI) Add(ctx context.Context, pth path.Path, opts ...options.PinAddOption) error {
+	defer p.cancel()
+	return p.PinAPI.Add(ctx, pth, opts...)
+}
+
+func TestUniqueSize(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t)
+
+	// dir contains file, so the file blocks are shared by both pins.
+	data := randomBytes(t, 1000)
+	file, err := ci.Add(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	dirNode := ipfsfiles.NewMapDirectory(map[string]ipfsfiles.Node{
+		"file": ipfsfiles.NewBytesFile(data),
+	})
+	p, err := ipfs.Unixfs().Add(ctx, dirNode, options.Unixfs.Pin(false))
+	require.NoError(t, err)
+	dir := p.Cid()
+	_, err = ci.Store(ctx, file)
+	require.NoError(t, err)
+	_, err = ci.Store(ctx, dir)
+	require.NoError(t, err)
+
+	dirRoot, err := ipfs.Block().Stat(ctx, path.IpfsPath(dir))
+	require.NoError(t, err)
+	fileRoot, err := ipfs.Block().Stat(ctx, path.IpfsPath(file))
+	require.NoError(t, err)
+
+	size, err := ci.UniqueSize(ctx, file)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), size)
+	size, err = ci.UniqueSize(ctx, dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(dirRoot.Size()), size)
+	require.Len(t, ci.uniqueSizes, 2)
+
+	// Removing dir drops the cache, and the file blocks become unique.
+	err = ci.Remove(context.WithValue(ctx, ffs.CtxStorageCid, dir), dir)
+	require.NoError(t, err)
+	require.Empty(t, ci.uniqueSizes)
+	size, err = ci.UniqueSize(ctx, file)
+	require.NoError(t, err)
+	require.Equal(t, int64(fileRoot.Size()), size)
+	require.Len(t, ci.uniqueSizes, 1)
+
+	// Storing dir again drops the cache too.
+	_, err = ci.Store(ctx, dir)
+	require.NoError(t, err)
+	require.Empty(t, ci.uniqueSizes)
+	size, err = ci.UniqueSize(ctx, file)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func TestDirectories(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ci, ipfs := createCoreIpfs(t)
+
+	data1 := randomBytes(t, 1000)
+	data2 := randomBytes(t, 1000)
+	f1, err := ci.Add(ctx, bytes.NewReader(data1))
+	require.NoError(t, err)
+	f2, err := ci.Add(ctx, bytes.NewReader(data2))
+	require.NoError(t, err)
+	_, err = ci.Ls(ctx, f1)
+	require.Equal(t, ErrNotDirectory, err)
+
+	dirNode := ipfsfiles.NewMapDirectory(map[string]ipfsfiles.Node{
+		"a": ipfsfiles.NewBytesFile(data1),
+		"sub": ipfsfiles.NewMapDirectory(map[string]ipfsfiles.Node{
+			"b": ipfsfiles.NewBytesFile(data2),
+		}),
+	})
+	p, err := ipfs.Unixfs().Add(ctx, dirNode, options.Unixfs.Pin(false))
+	require.NoError(t, err)
+	dir := p.Cid()
+
+	// The HAMT-sharded directory is built with the node DAG API,
+	// since sharding on add depends on the node configuration.
+	shard, err := hamt.NewShard(ipfs.Dag(), 256)
+	require.NoError(t, err)
+	for name, c := range map[string]cid.Cid{"a": f1, "b": f2} {
+		n, err := ipfs.Dag().Get(ctx, c)
+		require.NoError(t, err)
+		require.NoError(t, shard.Set(ctx, name, n))
+	}
+	shardNode, err := shard.Node()
+	require.NoError(t, err)
+	sharded := shardNode.Cid()
+
+	entries, err := ci.Ls(ctx, dir)
+	require.NoError(t, err)
+	requireDirEntries(t, entries, "a", "sub")
+	entries, err = ci.Ls(ctx, sharded)
+	require.NoError(t, err)
+	requireDirEntries(t, entries, "a", "b")
+
+	tests := []struct {
+		root     cid.Cid
+		subpath  string
+		expected []byte
+	}{
+		{root: dir, subpath: "sub/b", expected: data2},
+		{root: dir, subpath: "missing"},
+		{root: dir, subpath: "sub/missing"},
+		{root: sharded, subpath: "b", expected: data2},
+		{root: sharded, subpath: "missing"},
+	}
+	for _, tt := range tests {
+		r, err := ci.GetUnderPath(ctx, tt.root, tt.subpath)
+		if tt.expected == nil {
+			require.Equal(t, ErrPathNotFound, err, tt.subpath)
+			continue
+		}
+		require.NoError(t, err)
+		fetched, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, fetched)
+	}
+}
+
+func requireDirEntries(t *testing.T, entries []DirEntry, names ...string) {
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name)
+	}
+	require.ElementsMatch(t, names, got)
+}
+
+func createCoreIpfs(t *testing.T, opts ...Option) (*CoreIpfs, *httpapi.HttpApi) {
+	ipfsDocker, cls := tests.LaunchIPFSDocker(t)
+	t.Cleanup(cls)
+	ipfsAddr := util.MustParseAddr("/ip4/127.0.0.1/tcp/" + ipfsDocker.GetPort("5001/tcp"))
+	ipfs, err := httpapi.NewApi(ipfsAddr)
+	require.NoError(t, err)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	ci, err := New(ipfs, joblogger.New(ds), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, ci.Close()) })
+	return ci, ipfs
+}
+
+func requireNodePins(ctx context.Context, t *testing.T, ci *CoreIpfs, expected ...cid.Cid) {
+	pins, err := ci.NodePins(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expected, pins)
+	discrepancies, err := ci.SelfCheck(ctx)
+	require.NoError(t, err)
+	require.Empty(t, discrepancies)
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	require.NoError(t, err)
+	return buf
+}
@@ -0,0 +1,62 @@
+package coreipfs
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+)
+
+// walkDag traverses the DAG rooted at root breadth-first using the DAG API
+// of ipfs, getting every distinct block once. Blocks that aren't found are
+// counted as missing and their links aren't followed, and any other error
+// fetching a block aborts the walk. If visit isn't nil, it's called for every
+// fetched block. It returns the number of fetched and missing blocks.
+func walkDag(ctx context.Context, ipfs iface.CoreAPI, root cid.Cid, visit func(ipld.Node)) (int, int, error) {
+	// Pending fetches are canceled if the walk is aborted.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fetched, missing int
+	seen := map[cid.Cid]struct{}{root: {}}
+	frontier := []cid.Cid{root}
+	for len(frontier) > 0 {
+		var next []cid.Cid
+		for i := 0; i < len(frontier); i += getManyMaxParallel {
+			end := i + getManyMaxParallel
+			if end > len(frontier) {
+				end = len(frontier)
+			}
+			batch := frontier[i:end]
+			nodes := ipfs.Dag().GetMany(ctx, batch)
+			for range batch {
+				select {
+				case <-ctx.Done():
+					return fetched, missing, ctx.Err()
+				case no := <-nodes:
+					if no.Err != nil {
+						if !isNotFoundErr(no.Err) {
+							return fetched, missing, no.Err
+						}
+						missing++
+						continue
+					}
+					fetched++
+					if visit != nil {
+						visit(no.Node)
+					}
+					for _, l := range no.Node.Links() {
+						if _, ok := seen[l.Cid]; ok {
+							continue
+						}
+						seen[l.Cid] = struct{}{}
+						next = append(next, l.Cid)
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+	return fetched, missing, nil
+}
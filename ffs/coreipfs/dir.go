@@ -0,0 +1,98 @@
+package coreipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipfsfiles "github.com/ipfs/go-ipfs-files"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// pathNotFoundErrs are the messages of the node errors for a missing name
+// when resolving a path, for plain and HAMT-sharded directories.
+var pathNotFoundErrs = []string{
+	"no link named",
+	"file does not exist",
+}
+
+// DirEntry is an entry of a UnixFS directory.
+type DirEntry struct {
+	Name string
+	Cid  cid.Cid
+	Size int64
+	Type iface.FileType
+}
+
+// Ls lists the entries of the UnixFS directory c. HAMT-sharded directories
+// are listed transparently as a single directory. It returns ErrNotDirectory
+// if c isn't a directory.
+func (ci *CoreIpfs) Ls(ctx context.Context, c cid.Cid) ([]DirEntry, error) {
+	logger(ctx).Debugf("listing directory %s", c)
+	n, err := ci.GetNode(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	pn, ok := n.(*dag.ProtoNode)
+	if !ok {
+		return nil, ErrNotDirectory
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil, ErrNotDirectory
+	}
+	if fsn.Type() != unixfs.TDirectory && fsn.Type() != unixfs.THAMTShard {
+		return nil, ErrNotDirectory
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	entries, err := ci.ipfs.Unixfs().Ls(ctx, path.IpfsPath(c))
+	if err != nil {
+		return nil, fmt.Errorf("listing directory %s: %s", c, err)
+	}
+	var res []DirEntry
+	for e := range entries {
+		if e.Err != nil {
+			return nil, fmt.Errorf("listing directory %s entries: %s", c, e.Err)
+		}
+		res = append(res, DirEntry{
+			Name: e.Name,
+			Cid:  e.Cid,
+			Size: int64(e.Size),
+			Type: e.Type,
+		})
+	}
+	return res, nil
+}
+
+// GetUnderPath retrieves the file at subpath relative to the directory root,
+// e.g: "docs/readme.txt". It returns ErrPathNotFound if subpath doesn't
+// exist under root.
+func (ci *CoreIpfs) GetUnderPath(ctx context.Context, root cid.Cid, subpath string) (io.Reader, error) {
+	logger(ctx).Debugf("getting %s under %s", subpath, root)
+	p := path.Join(path.IpfsPath(root), strings.Trim(subpath, "/"))
+	rp, err := ci.ipfs.ResolvePath(ctx, p)
+	if err != nil {
+		for _, msg := range pathNotFoundErrs {
+			if strings.Contains(err.Error(), msg) {
+				return nil, ErrPathNotFound
+			}
+		}
+		return nil, fmt.Errorf("resolving path %s: %s", p, err)
+	}
+	n, err := ci.ipfs.Unixfs().Get(ctx, rp)
+	if err != nil {
+		return nil, fmt.Errorf("getting path %s from ipfs: %s", p, err)
+	}
+	file := ipfsfiles.ToFile(n)
+	if file == nil {
+		return nil, fmt.Errorf("node is a directory")
+	}
+	return file, nil
+}
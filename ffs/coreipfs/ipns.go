@@ -0,0 +1,294 @@
+package coreipfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/textileio/powergate/ffs"
+)
+
+// StoreIPNS resolves the IPNS name to its current cid and stores it. The
+// name is tracked so a later RefreshIPNS can follow it if it's updated, until
+// UntrackIPNS is called. If the name was already tracked and points to a new
+// cid, the previous one is handled as in RefreshIPNS. Tracked names are kept
+// in memory and aren't persisted across restarts.
+//
+// Hot storage isn't ref-counted, and a followed cid is removed once no
+// tracked name points to it, so names must not point to cids which are
+// also managed by storage configs.
+func (ci *CoreIpfs) StoreIPNS(ctx context.Context, name string) (cid.Cid, int, error) {
+	c, err := ci.resolveIPNS(ctx, name)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	size, err := ci.Store(ctx, c)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	if err := ci.track(ctx, name, c); err != nil {
+		return c, size, err
+	}
+	return c, size, nil
+}
+
+// RefreshIPNS re-resolves a name stored with StoreIPNS, and if it points to
+// a new cid, stores it. The previous cid is removed unless another tracked
+// name still points to it. It returns the current cid of the name and if
+// it changed.
+func (ci *CoreIpfs) RefreshIPNS(ctx context.Context, name string) (cid.Cid, bool, error) {
+	ci.lock.Lock()
+	old, ok := ci.ipnsNames[name]
+	ci.lock.Unlock()
+	if !ok {
+		return cid.Undef, false, fmt.Errorf("ipns name %s isn't tracked", name)
+	}
+	c, err := ci.resolveIPNS(ctx, name)
+	if err != nil {
+		return cid.Undef, false, err
+	}
+	if c.Equals(old) {
+		return c, false, nil
+	}
+	logger(ctx).Debugf("ipns name %s moved from %s to %s", name, old, c)
+	if _, err := ci.Store(ctx, c); err != nil {
+		return cid.Undef, false, err
+	}
+	if err := ci.track(ctx, name, c); err != nil {
+		return c, true, err
+	}
+	return c, true, nil
+}
+
+// UntrackIPNS stops tracking a name stored with StoreIPNS, and removes its
+// cid unless another tracked name points to it.
+func (ci *CoreIpfs) UntrackIPNS(ctx context.Context, name string) error {
+	ci.lock.Lock()
+	c, ok := ci.ipnsNames[name]
+	if !ok {
+		ci.lock.Unlock()
+		return fmt.Errorf("ipns name %s isn't tracked", name)
+	}
+	delete(ci.ipnsNames, name)
+	release := !ci.isTracked(c)
+	if release {
+		delete(ci.ipnsExpiring, c)
+	}
+	ci.lock.Unlock()
+	if release {
+		if err := ci.removeFollowed(ctx, c); err != nil {
+			return fmt.Errorf("removing cid %s: %s", c, err)
+		}
+	}
+	return nil
+}
+
+// track sets c as the current cid of name, and removes the cid it pointed
+// to before unless another tracked name still points to it.
+func (ci *CoreIpfs) track(ctx context.Context, name string, c cid.Cid) error {
+	ci.lock.Lock()
+	old, ok := ci.ipnsNames[name]
+	ci.ipnsNames[name] = c
+	release := ok && !ci.isTracked(old)
+	if release {
+		delete(ci.ipnsExpiring, old)
+	}
+	ci.lock.Unlock()
+	if release {
+		if err := ci.removeFollowed(ctx, old); err != nil {
+			return fmt.Errorf("removing previous cid %s: %s", old, err)
+		}
+	}
+	return nil
+}
+
+// isTracked returns true if a tracked name points to the content of c.
+// It must be called with ci.lock held.
+func (ci *CoreIpfs) isTracked(c cid.Cid) bool {
+	for _, tc := range ci.ipnsNames {
+		if pinsetKey(tc) == pinsetKey(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ci *CoreIpfs) resolveIPNS(ctx context.Context, name string) (cid.Cid, error) {
+	p, err := ci.ipfs.Name().Resolve(ctx, name)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("resolving ipns name %s: %s", name, err)
+	}
+	rp, err := ci.ipfs.ResolvePath(ctx, p)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("resolving path %s: %s", p, err)
+	}
+	return rp.Cid(), nil
+}
+
+// IPNSFollow describes a tracked IPNS name that was followed
+// to a new cid.
+type IPNSFollow struct {
+	Name string
+	From cid.Cid
+	To   cid.Cid
+}
+
+// WatchIPNS sends to ch every tracked name followed by the IPNS follower,
+// until ctx is canceled. It returns an error if hot storage is closed
+// while watching.
+func (ci *CoreIpfs) WatchIPNS(ctx context.Context, ch chan<- IPNSFollow) error {
+	ci.clsLock.Lock()
+	if ci.closed {
+		ci.clsLock.Unlock()
+		return fmt.Errorf("hot storage is closed")
+	}
+	ci.lock.Lock()
+	ic := make(chan IPNSFollow, 1)
+	ci.ipnsWatchers = append(ci.ipnsWatchers, ic)
+	ci.lock.Unlock()
+	ci.clsLock.Unlock()
+
+	stop := false
+	for !stop {
+		select {
+		case <-ctx.Done():
+			stop = true
+		case f, ok := <-ic:
+			if !ok {
+				return fmt.Errorf("hot storage was closed with a listening client")
+			}
+			ch <- f
+		}
+	}
+
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	for i := range ci.ipnsWatchers {
+		if ci.ipnsWatchers[i] == ic {
+			ci.ipnsWatchers = append(ci.ipnsWatchers[:i], ci.ipnsWatchers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// followIPNS is a long running job that follows tracked IPNS names.
+func (ci *CoreIpfs) followIPNS() {
+	for {
+		select {
+		case <-ci.ctx.Done():
+			log.Info("graceful shutdown of ipns follower")
+			return
+		case <-time.After(ci.cfg.ipnsInterval):
+			ci.followNames()
+			ci.removeExpired()
+		}
+	}
+}
+
+func (ci *CoreIpfs) followNames() {
+	ci.lock.Lock()
+	names := make(map[string]cid.Cid, len(ci.ipnsNames))
+	for name, c := range ci.ipnsNames {
+		names[name] = c
+	}
+	ci.lock.Unlock()
+
+	for name, old := range names {
+		ctx, cancel := context.WithTimeout(ci.ctx, ci.cfg.ipnsInterval)
+		c, err := ci.resolveIPNS(ctx, name)
+		if err == nil && !c.Equals(old) {
+			_, err = ci.Store(context.WithValue(ctx, ffs.CtxStorageCid, c), c)
+		}
+		cancel()
+		if ci.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("following ipns name %s: %s", name, err)
+			continue
+		}
+		if c.Equals(old) {
+			continue
+		}
+		f := IPNSFollow{Name: name, From: old, To: c}
+		ci.lock.Lock()
+		if current, ok := ci.ipnsNames[name]; !ok || !current.Equals(old) {
+			// The name was refreshed or untracked meanwhile, so c is
+			// removed unless it's in use.
+			release := !ci.isTracked(c)
+			ci.lock.Unlock()
+			if release {
+				ctx, cancel := context.WithTimeout(ci.ctx, ci.cfg.ipnsInterval)
+				err := ci.removeFollowed(ctx, c)
+				cancel()
+				if err != nil {
+					log.Errorf("removing followed cid %s: %s", c, err)
+				}
+			}
+			continue
+		}
+		log.Infof("ipns name %s followed from %s to %s", name, old, c)
+		ci.ipnsNames[name] = c
+		delete(ci.ipnsExpiring, c)
+		ci.ipnsExpiring[old] = time.Now().Add(ci.cfg.ipnsGrace)
+		for _, w := range ci.ipnsWatchers {
+			select {
+			case w <- f:
+			default:
+				log.Warnf("slow ipns watcher, skipping follow notification")
+			}
+		}
+		ci.lock.Unlock()
+	}
+}
+
+// removeExpired removes the cids whose grace period finished, unless a
+// tracked name points to them again.
+func (ci *CoreIpfs) removeExpired() {
+	now := time.Now()
+	ci.lock.Lock()
+	var expired []cid.Cid
+	for c, t := range ci.ipnsExpiring {
+		if ci.isTracked(c) {
+			delete(ci.ipnsExpiring, c)
+			continue
+		}
+		if now.After(t) {
+			expired = append(expired, c)
+		}
+	}
+	ci.lock.Unlock()
+
+	for _, c := range expired {
+		ctx, cancel := context.WithTimeout(ci.ctx, ci.cfg.ipnsInterval)
+		err := ci.removeFollowed(ctx, c)
+		cancel()
+		if err != nil {
+			log.Errorf("removing expired ipns cid %s: %s", c, err)
+			continue
+		}
+		ci.lock.Lock()
+		delete(ci.ipnsExpiring, c)
+		ci.lock.Unlock()
+	}
+}
+
+// removeFollowed removes a cid which no tracked name points to anymore.
+// If it was already unpinned, e.g: out-of-band, it's considered removed.
+func (ci *CoreIpfs) removeFollowed(ctx context.Context, c cid.Cid) error {
+	err := ci.Remove(context.WithValue(ctx, ffs.CtxStorageCid, c), c)
+	if err != nil && isNotPinnedErr(err) {
+		logger(ctx).Debugf("followed cid %s was already unpinned", c)
+		return nil
+	}
+	return err
+}
+
+// isNotPinnedErr returns if err is the node error for unpinning a cid
+// which isn't pinned. As in isNotFoundErr, it's matched by text.
+func isNotPinnedErr(err error) bool {
+	return strings.Contains(err.Error(), "not pinned")
+}
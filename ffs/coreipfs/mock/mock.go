@@ -0,0 +1,116 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/textileio/powergate/ffs"
+)
+
+var _ ffs.HotStorage = (*HotStorage)(nil)
+
+// HotStorage provides an in-memory mock of ffs.HotStorage. Added data is
+// kept in a map keyed by a raw Cid computed from its bytes. As in CoreIpfs,
+// stored Cids are a set and not ref-counted: storing twice is a no-op and a
+// single Remove unstores it, while removing a Cid which isn't stored fails.
+// Cids are normalized to CIDv1, so a Cid is stored for every version. Since
+// there's no network, only previously Added data can be stored.
+type HotStorage struct {
+	lock   sync.Mutex
+	data   map[cid.Cid][]byte
+	stored map[cid.Cid]struct{}
+}
+
+// New returns a new HotStorage mock.
+func New() *HotStorage {
+	return &HotStorage{
+		data:   make(map[cid.Cid][]byte),
+		stored: make(map[cid.Cid]struct{}),
+	}
+}
+
+// Add implements Add.
+func (hs *HotStorage) Add(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("reading data: %s", err)
+	}
+	pref := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}
+	c, err := pref.Sum(b)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("calculating cid: %s", err)
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.data[c] = b
+	return c, nil
+}
+
+// Remove implements Remove.
+func (hs *HotStorage) Remove(ctx context.Context, c cid.Cid) error {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, ok := hs.stored[key(c)]; !ok {
+		return fmt.Errorf("cid %s isn't stored", c)
+	}
+	delete(hs.stored, key(c))
+	return nil
+}
+
+// Get implements Get.
+func (hs *HotStorage) Get(ctx context.Context, c cid.Cid) (io.Reader, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	b, ok := hs.data[key(c)]
+	if !ok {
+		return nil, fmt.Errorf("cid %s not found", c)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// Store implements Store.
+func (hs *HotStorage) Store(ctx context.Context, c cid.Cid) (int, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	b, ok := hs.data[key(c)]
+	if !ok {
+		return 0, fmt.Errorf("cid %s not found", c)
+	}
+	hs.stored[key(c)] = struct{}{}
+	return len(b), nil
+}
+
+// Replace implements Replace.
+func (hs *HotStorage) Replace(ctx context.Context, c1 cid.Cid, c2 cid.Cid) (int, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, ok := hs.stored[key(c1)]; !ok {
+		return 0, fmt.Errorf("cid %s isn't stored", c1)
+	}
+	b, ok := hs.data[key(c2)]
+	if !ok {
+		return 0, fmt.Errorf("cid %s not found", c2)
+	}
+	delete(hs.stored, key(c1))
+	hs.stored[key(c2)] = struct{}{}
+	return len(b), nil
+}
+
+// IsStored implements IsStored.
+func (hs *HotStorage) IsStored(ctx context.Context, c cid.Cid) (bool, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	_, ok := hs.stored[key(c)]
+	return ok, nil
+}
+
+// key normalizes c to CIDv1, as CoreIpfs does for its pinset.
+func key(c cid.Cid) cid.Cid {
+	return cid.NewCidV1(c.Type(), c.Hash())
+}
@@ -0,0 +1,53 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreSemantics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	hs := New()
+
+	c1, err := hs.Add(ctx, bytes.NewReader([]byte("hello")))
+	require.NoError(t, err)
+	c2, err := hs.Add(ctx, bytes.NewReader([]byte("world")))
+	require.NoError(t, err)
+	require.NotEqual(t, c1, c2)
+
+	r, err := hs.Get(ctx, c1)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+
+	// Storing twice isn't ref-counted, a single Remove unstores.
+	size, err := hs.Store(ctx, c1)
+	require.NoError(t, err)
+	require.Equal(t, 5, size)
+	_, err = hs.Store(ctx, c1)
+	require.NoError(t, err)
+	require.NoError(t, hs.Remove(ctx, c1))
+	stored, err := hs.IsStored(ctx, c1)
+	require.NoError(t, err)
+	require.False(t, stored)
+	require.Error(t, hs.Remove(ctx, c1))
+
+	_, err = hs.Replace(ctx, c1, c2)
+	require.Error(t, err)
+	_, err = hs.Store(ctx, c1)
+	require.NoError(t, err)
+	_, err = hs.Replace(ctx, c1, c2)
+	require.NoError(t, err)
+	stored, err = hs.IsStored(ctx, c2)
+	require.NoError(t, err)
+	require.True(t, stored)
+	stored, err = hs.IsStored(ctx, c1)
+	require.NoError(t, err)
+	require.False(t, stored)
+}
@@ -0,0 +1,49 @@
+package coreipfs
+
+import (
+	"context"
+	"time"
+)
+
+// IsAvailable returns false if the connectivity monitor detected that the
+// IPFS node is down. If the monitor is disabled, it always returns true.
+func (ci *CoreIpfs) IsAvailable() bool {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	return ci.available
+}
+
+// monitor is a long running job that checks the IPFS node availability.
+func (ci *CoreIpfs) monitor() {
+	for {
+		select {
+		case <-ci.ctx.Done():
+			log.Info("graceful shutdown of connectivity monitor")
+			return
+		case <-time.After(ci.cfg.monitorInterval):
+			ci.checkConnectivity()
+		}
+	}
+}
+
+func (ci *CoreIpfs) checkConnectivity() {
+	ctx, cancel := context.WithTimeout(ci.ctx, ci.cfg.monitorInterval)
+	defer cancel()
+	_, err := ci.ipfs.Key().Self(ctx)
+	if ci.ctx.Err() != nil {
+		return
+	}
+	available := err == nil
+
+	ci.lock.Lock()
+	changed := ci.available != available
+	ci.available = available
+	ci.lock.Unlock()
+
+	if changed && !available {
+		log.Errorf("ipfs node is unavailable: %s", err)
+	}
+	if changed && available {
+		log.Info("ipfs node is available again")
+	}
+}
@@ -0,0 +1,60 @@
+package coreipfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// offlinePinKey is the ctx key of the WithOfflinePin override.
+type offlinePinKey struct{}
+
+// notFoundErrs are the messages of the missing block errors of
+// the node blockstore, blockservice and merkledag.
+var notFoundErrs = []string{
+	"blockstore: block not found",
+	"blockservice: key not found",
+	"merkledag: not found",
+}
+
+// WithOfflinePin returns a copy of ctx which overrides the WithOfflinePinOnly
+// configuration for Store and Replace calls made with it.
+func WithOfflinePin(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, offlinePinKey{}, enabled)
+}
+
+// isOfflinePin returns if pinning should be done in offline mode, using the
+// ctx override if present.
+func (ci *CoreIpfs) isOfflinePin(ctx context.Context) bool {
+	if enabled, ok := ctx.Value(offlinePinKey{}).(bool); ok {
+		return enabled
+	}
+	return ci.cfg.offlinePin
+}
+
+// pinAPI returns the api to use for pinning.
+func (ci *CoreIpfs) pinAPI(offline bool) (iface.CoreAPI, error) {
+	if !offline {
+		return ci.ipfs, nil
+	}
+	api, err := ci.ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return nil, fmt.Errorf("creating offline api: %s", err)
+	}
+	return api, nil
+}
+
+// isNotFoundErr returns if err is a missing block error returned by the
+// node. The HTTP client only has the error message, so it's matched
+// by text.
+func isNotFoundErr(err error) bool {
+	for _, msg := range notFoundErrs {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
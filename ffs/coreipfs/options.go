@@ -0,0 +1,67 @@
+package coreipfs
+
+import "time"
+
+// config contains configuration for CoreIpfs.
+type config struct {
+	verifyAdd       bool
+	monitorInterval time.Duration
+	chunkSize       int
+	offlinePin      bool
+	ipnsInterval    time.Duration
+	ipnsGrace       time.Duration
+}
+
+// Option sets values on a CoreIpfs configuration.
+type Option func(*config)
+
+// WithAddVerification indicates to verify that the root block of added
+// data is present in the IPFS node before returning from Add. It's
+// disabled by default since it adds an extra call to the node.
+func WithAddVerification(enabled bool) Option {
+	return func(c *config) {
+		c.verifyAdd = enabled
+	}
+}
+
+// WithConnectivityMonitor enables a background check of the IPFS node
+// availability every interval. While the node is considered down, calls
+// mutating hot storage fail fast with ErrHotStorageUnavailable, and they're
+// allowed again when the node recovers. It's disabled by default.
+func WithConnectivityMonitor(interval time.Duration) Option {
+	return func(c *config) {
+		c.monitorInterval = interval
+	}
+}
+
+// WithChunkSize sets the size in bytes of the blocks in which added data is
+// split. Data is streamed to the IPFS node in a multipart request, so the
+// chunk size bounds how much of it the node buffers per block; it must be
+// between 1 byte and maxChunkSize. The node default is used if not set.
+func WithChunkSize(size int) Option {
+	return func(c *config) {
+		c.chunkSize = size
+	}
+}
+
+// WithOfflinePinOnly indicates that Store and Replace should pin using only
+// blocks already available in the IPFS node, failing with ErrBlockNotLocal
+// instead of fetching missing blocks from the network. It can be overridden
+// per call with WithOfflinePin.
+func WithOfflinePinOnly(enabled bool) Option {
+	return func(c *config) {
+		c.offlinePin = enabled
+	}
+}
+
+// WithIPNSFollow enables a background job that re-resolves names stored with
+// StoreIPNS every interval. When a name points to a new cid, the new cid is
+// stored and the previous one is removed after grace, unless another tracked
+// name still points to it. Followed cids must not be managed by storage
+// configs too, see StoreIPNS. It's disabled by default.
+func WithIPNSFollow(interval, grace time.Duration) Option {
+	return func(c *config) {
+		c.ipnsInterval = interval
+		c.ipnsGrace = grace
+	}
+}
@@ -0,0 +1,33 @@
+package coreipfs
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// requestIDKey is the ctx key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying a request ID. CoreIpfs
+// operations called with the returned context include the ID in their
+// log lines, so they can be correlated with upstream systems.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or an empty
+// string if none was set.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the package logger, annotated with the request ID
+// of ctx if present.
+func logger(ctx context.Context) *zap.SugaredLogger {
+	if id := RequestID(ctx); id != "" {
+		return log.With("reqid", id)
+	}
+	return &log.SugaredLogger
+}
@@ -0,0 +1,255 @@
+package localipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipfsfiles "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+	dag "github.com/ipfs/go-merkledag"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	"github.com/ipfs/go-unixfs/importer"
+	"github.com/textileio/powergate/ffs"
+)
+
+var (
+	log = logging.Logger("ffs-localipfs")
+)
+
+// LocalIpfs is an implementation of HotStorage interface which saves data
+// in a local blockstore, without needing a running go-ipfs node. Since it
+// has no network access, it can only Store Cids whose data was previously
+// Added or is already available in the blockstore.
+//
+// Pins are persisted in the datastore. Removed or unpinned data stays in
+// the blockstore until GC is called. As in CoreIpfs, cids are normalized to
+// CIDv1, so content stored as CIDv0 is also stored for its CIDv1, and
+// removing a cid which isn't stored fails.
+type LocalIpfs struct {
+	bs   blockstore.Blockstore
+	dag  ipld.DAGService
+	pins datastore.Batching
+	l    ffs.JobLogger
+
+	lock   sync.Mutex
+	pinset map[cid.Cid]struct{}
+}
+
+var _ ffs.HotStorage = (*LocalIpfs)(nil)
+
+// New returns a new LocalIpfs instance, storing blocks and pins in ds.
+func New(ds datastore.Batching, l ffs.JobLogger) (*LocalIpfs, error) {
+	bs := blockstore.NewBlockstore(namespace.Wrap(ds, datastore.NewKey("blocks")))
+	li := &LocalIpfs{
+		bs:   bs,
+		dag:  dag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		pins: namespace.Wrap(ds, datastore.NewKey("pins")),
+		l:    l,
+	}
+	if err := li.loadPinset(); err != nil {
+		return nil, err
+	}
+	return li, nil
+}
+
+// Add adds an io.Reader data as a UnixFS file in the blockstore, without
+// pinning it. The resulting Cid is the same as adding it to go-ipfs with
+// default options.
+func (li *LocalIpfs) Add(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	log.Debugf("adding data-stream...")
+	n, err := importer.BuildDagFromReader(li.dag, chunker.DefaultSplitter(r))
+	if err != nil {
+		return cid.Undef, fmt.Errorf("adding data to blockstore: %s", err)
+	}
+	log.Debugf("data-stream added with cid %s", n.Cid())
+	return n.Cid(), nil
+}
+
+// Remove removes a Cid from hot storage.
+func (li *LocalIpfs) Remove(ctx context.Context, c cid.Cid) error {
+	log.Debugf("removing cid %s", c)
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if _, ok := li.pinset[pinsetKey(c)]; !ok {
+		return fmt.Errorf("cid %s isn't pinned", c)
+	}
+	if err := li.pins.Delete(pinKey(c)); err != nil {
+		return fmt.Errorf("deleting pin from datastore: %s", err)
+	}
+	delete(li.pinset, pinsetKey(c))
+	li.l.Log(ctx, "Cid data was unpinned in local blockstore.")
+	return nil
+}
+
+// IsStored return if a particular Cid is stored.
+func (li *LocalIpfs) IsStored(ctx context.Context, c cid.Cid) (bool, error) {
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	_, ok := li.pinset[pinsetKey(c)]
+	return ok, nil
+}
+
+// Get retrieves a cid from the blockstore.
+func (li *LocalIpfs) Get(ctx context.Context, c cid.Cid) (io.Reader, error) {
+	log.Debugf("getting cid %s", c)
+	n, err := li.dag.Get(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("getting cid %s from blockstore: %s", c, err)
+	}
+	f, err := unixfile.NewUnixfsFile(ctx, li.dag, n)
+	if err != nil {
+		return nil, fmt.Errorf("opening cid %s as a file: %s", c, err)
+	}
+	file := ipfsfiles.ToFile(f)
+	if file == nil {
+		return nil, fmt.Errorf("node is a directory")
+	}
+	return file, nil
+}
+
+// Store stores a Cid in the HotStorage. All the DAG blocks must already be
+// in the blockstore, since there's no network to fetch them from.
+func (li *LocalIpfs) Store(ctx context.Context, c cid.Cid) (int, error) {
+	log.Debugf("pinning cid %s", c)
+	size, err := li.checkComplete(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if err := li.pins.Put(pinKey(c), []byte{}); err != nil {
+		return 0, fmt.Errorf("saving pin in datastore: %s", err)
+	}
+	li.pinset[pinsetKey(c)] = struct{}{}
+	return size, nil
+}
+
+// Replace replaces a stored Cid with other Cid.
+func (li *LocalIpfs) Replace(ctx context.Context, c1 cid.Cid, c2 cid.Cid) (int, error) {
+	log.Debugf("updating pin from %s to %s", c1, c2)
+	size, err := li.checkComplete(ctx, c2)
+	if err != nil {
+		return 0, err
+	}
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if _, ok := li.pinset[pinsetKey(c1)]; !ok {
+		return 0, fmt.Errorf("cid %s isn't pinned", c1)
+	}
+	if pinsetKey(c1) == pinsetKey(c2) {
+		return size, nil
+	}
+	b, err := li.pins.Batch()
+	if err != nil {
+		return 0, fmt.Errorf("creating batch: %s", err)
+	}
+	if err := b.Delete(pinKey(c1)); err != nil {
+		return 0, fmt.Errorf("deleting pin in batch: %s", err)
+	}
+	if err := b.Put(pinKey(c2), []byte{}); err != nil {
+		return 0, fmt.Errorf("saving pin in batch: %s", err)
+	}
+	if err := b.Commit(); err != nil {
+		return 0, fmt.Errorf("committing batch: %s", err)
+	}
+	delete(li.pinset, pinsetKey(c1))
+	li.pinset[pinsetKey(c2)] = struct{}{}
+	return size, nil
+}
+
+// GC deletes from the blockstore all blocks which aren't reachable from
+// a stored Cid. It returns the number of deleted blocks.
+func (li *LocalIpfs) GC(ctx context.Context) (int, error) {
+	li.lock.Lock()
+	defer li.lock.Unlock()
+
+	reachable := cid.NewSet()
+	for c := range li.pinset {
+		if err := dag.Walk(ctx, dag.GetLinksWithDAG(li.dag), c, reachable.Visit); err != nil {
+			return 0, fmt.Errorf("walking dag of cid %s: %s", c, err)
+		}
+	}
+	// The blockstore is keyed by multihash, so reachable blocks are
+	// compared by hash and not by Cid version or codec.
+	reachableHashes := make(map[string]struct{}, reachable.Len())
+	_ = reachable.ForEach(func(c cid.Cid) error {
+		reachableHashes[string(c.Hash())] = struct{}{}
+		return nil
+	})
+	keys, err := li.bs.AllKeysChan(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("listing blockstore keys: %s", err)
+	}
+	var deleted int
+	for c := range keys {
+		if _, ok := reachableHashes[string(c.Hash())]; ok {
+			continue
+		}
+		if err := li.bs.DeleteBlock(c); err != nil {
+			return deleted, fmt.Errorf("deleting block %s: %s", c, err)
+		}
+		deleted++
+	}
+	log.Infof("gc deleted %d blocks", deleted)
+	return deleted, nil
+}
+
+// checkComplete verifies that all the DAG blocks of c are in the
+// blockstore, and returns its cumulative size.
+func (li *LocalIpfs) checkComplete(ctx context.Context, c cid.Cid) (int, error) {
+	n, err := li.dag.Get(ctx, c)
+	if err != nil {
+		return 0, fmt.Errorf("getting cid %s from blockstore: %s", c, err)
+	}
+	if err := dag.Walk(ctx, dag.GetLinksWithDAG(li.dag), c, cid.NewSet().Visit); err != nil {
+		return 0, fmt.Errorf("cid %s dag isn't complete in blockstore: %s", c, err)
+	}
+	size, err := n.Size()
+	if err != nil {
+		return 0, fmt.Errorf("getting size of cid %s: %s", c, err)
+	}
+	return int(size), nil
+}
+
+func (li *LocalIpfs) loadPinset() error {
+	q := query.Query{KeysOnly: true}
+	res, err := li.pins.Query(q)
+	if err != nil {
+		return fmt.Errorf("querying pins: %s", err)
+	}
+	defer func() { _ = res.Close() }()
+	li.pinset = map[cid.Cid]struct{}{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return fmt.Errorf("iterating query result: %s", r.Error)
+		}
+		c, err := cid.Decode(datastore.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			return fmt.Errorf("decoding pin key %s: %s", r.Key, err)
+		}
+		// Keys are saved normalized by pinKey.
+		li.pinset[c] = struct{}{}
+	}
+	return nil
+}
+
+func pinKey(c cid.Cid) datastore.Key {
+	return datastore.NewKey(pinsetKey(c).String())
+}
+
+// pinsetKey normalizes c to CIDv1, so the same content addressed as CIDv0
+// or CIDv1 maps to a single pin.
+func pinsetKey(c cid.Cid) cid.Cid {
+	return cid.NewCidV1(c.Type(), c.Hash())
+}
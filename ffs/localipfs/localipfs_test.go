@@ -0,0 +1,161 @@
+package localipfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"github.com/textileio/powergate/ffs"
+	"github.com/textileio/powergate/ffs/joblogger"
+)
+
+func TestAddGet(t *testing.T) {
+	t.Parallel()
+	li, _ := create(t)
+	ctx := context.Background()
+
+	data := randomBytes(t, 1, 600000)
+	c, err := li.Add(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	// Same cid as `ipfs add` with default options.
+	require.Equal(t, 0, int(c.Version()))
+
+	r, err := li.Get(ctx, c)
+	require.NoError(t, err)
+	fetched, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, fetched)
+
+	stored, err := li.IsStored(ctx, c)
+	require.NoError(t, err)
+	require.False(t, stored)
+}
+
+func TestStoreRemove(t *testing.T) {
+	t.Parallel()
+	li, ds := create(t)
+	ctx := context.Background()
+
+	c, err := li.Add(ctx, bytes.NewReader(randomBytes(t, 1, 1000)))
+	require.NoError(t, err)
+	size, err := li.Store(ctx, c)
+	require.NoError(t, err)
+	require.Greater(t, size, 1000)
+	stored, err := li.IsStored(ctx, c)
+	require.NoError(t, err)
+	require.True(t, stored)
+
+	// Pins survive restarts.
+	li2, err := New(ds, joblogger.New(ds))
+	require.NoError(t, err)
+	stored, err = li2.IsStored(ctx, c)
+	require.NoError(t, err)
+	require.True(t, stored)
+
+	ctx = context.WithValue(ctx, ffs.CtxStorageCid, c)
+	err = li.Remove(ctx, c)
+	require.NoError(t, err)
+	stored, err = li.IsStored(ctx, c)
+	require.NoError(t, err)
+	require.False(t, stored)
+}
+
+func TestCidVersions(t *testing.T) {
+	t.Parallel()
+	li, _ := create(t)
+	ctx := context.Background()
+
+	v0, err := li.Add(ctx, bytes.NewReader(randomBytes(t, 1, 1000)))
+	require.NoError(t, err)
+	v1 := cid.NewCidV1(v0.Type(), v0.Hash())
+
+	_, err = li.Store(ctx, v0)
+	require.NoError(t, err)
+	stored, err := li.IsStored(ctx, v1)
+	require.NoError(t, err)
+	require.True(t, stored)
+
+	ctx = context.WithValue(ctx, ffs.CtxStorageCid, v1)
+	err = li.Remove(ctx, v1)
+	require.NoError(t, err)
+	stored, err = li.IsStored(ctx, v0)
+	require.NoError(t, err)
+	require.False(t, stored)
+
+	// Removing a cid which isn't stored fails, as in CoreIpfs.
+	err = li.Remove(ctx, v0)
+	require.Error(t, err)
+}
+
+func TestReplace(t *testing.T) {
+	t.Parallel()
+	li, _ := create(t)
+	ctx := context.Background()
+
+	c1, err := li.Add(ctx, bytes.NewReader(randomBytes(t, 1, 1000)))
+	require.NoError(t, err)
+	c2, err := li.Add(ctx, bytes.NewReader(randomBytes(t, 2, 1000)))
+	require.NoError(t, err)
+
+	_, err = li.Replace(ctx, c1, c2)
+	require.Error(t, err)
+
+	_, err = li.Store(ctx, c1)
+	require.NoError(t, err)
+	_, err = li.Replace(ctx, c1, c2)
+	require.NoError(t, err)
+
+	stored, err := li.IsStored(ctx, c1)
+	require.NoError(t, err)
+	require.False(t, stored)
+	stored, err = li.IsStored(ctx, c2)
+	require.NoError(t, err)
+	require.True(t, stored)
+}
+
+func TestGC(t *testing.T) {
+	t.Parallel()
+	li, _ := create(t)
+	ctx := context.Background()
+
+	c1, err := li.Add(ctx, bytes.NewReader(randomBytes(t, 1, 600000)))
+	require.NoError(t, err)
+	c2, err := li.Add(ctx, bytes.NewReader(randomBytes(t, 2, 600000)))
+	require.NoError(t, err)
+	_, err = li.Store(ctx, c1)
+	require.NoError(t, err)
+
+	deleted, err := li.GC(ctx)
+	require.NoError(t, err)
+	require.Greater(t, deleted, 0)
+
+	_, err = li.Get(ctx, c1)
+	require.NoError(t, err)
+	_, err = li.Get(ctx, c2)
+	require.Error(t, err)
+
+	// Unavailable data can't be stored, since there isn't a network.
+	_, err = li.Store(ctx, c2)
+	require.Error(t, err)
+}
+
+func create(t *testing.T) (*LocalIpfs, datastore.Batching) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	li, err := New(ds, joblogger.New(ds))
+	require.NoError(t, err)
+	return li, ds
+}
+
+func randomBytes(t *testing.T, seed int64, size int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	buf := make([]byte, size)
+	_, err := r.Read(buf)
+	require.NoError(t, err)
+	return buf
+}